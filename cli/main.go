@@ -1,44 +1,126 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"time"
+	"os"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/Dhole/wallapop-rss/walla"
 )
 
+// listFlag is a flag that can be repeated or given as a comma-separated
+// list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// printShort prints one line per search result.
+func printShort(res *walla.ResSearch) {
+	for _, object := range res.SearchObjects {
+		fmt.Printf("%v - %v %v (%.1f km) %v\n", object.Title, object.Price, object.Currency,
+			object.Distance, object.URL())
+	}
+}
+
+// printTable prints the search results as a table aligned by columns.
+func printTable(res *walla.ResSearch) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tPRICE\tDISTANCE\tURL")
+	for _, object := range res.SearchObjects {
+		fmt.Fprintf(w, "%v\t%v %v\t%.1f km\t%v\n", object.Title, object.Price, object.Currency,
+			object.Distance, object.URL())
+	}
+	w.Flush()
+}
+
 func main() {
-	keyword := flag.String("keyword", "", "search keyword")
+	var keywords listFlag
+	flag.Var(&keywords, "keyword", "search keyword (repeatable or comma-separated)")
+	var ignores listFlag
+	flag.Var(&ignores, "ignore", "ignore results containing this term in the title or "+
+		"description (repeatable or comma-separated)")
 	locationName := flag.String("locationName", "", "location place name")
-	locationRadius := flag.Uint64("locationRadius", 5, "location radius")
+	locationRadius := flag.Uint64("locationRadius", 5, "location radius (km)")
 	minPrice := flag.Uint64("minPrice", 0, "minimum price")
-	maxPrice := flag.Uint64("maxPrice", 9999, "maximum price")
+	maxPrice := flag.Uint64("maxPrice", 0, "maximum price (unlimited if 0)")
+	language := flag.String("language", walla.DefaultLanguage, "search language: "+
+		strings.Join(walla.Languages, ", "))
+	age := flag.Duration("age", walla.DefaultSearchAge, "age of the oldest results")
+	format := flag.String("format", "json", "output format: json, table or short")
 	flag.Parse()
 
-	location, err := walla.GetLocation(*locationName)
-	if err != nil {
-		log.Fatal(err)
+	switch *format {
+	case "json", "table", "short":
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if !walla.ValidLanguage(*language) {
+		log.Fatalf("unknown language %q", *language)
 	}
-	req := walla.ReqSearch{
-		Distance:      float32(*locationRadius * 1000),
-		Keywords:      *keyword,
-		FiltersSource: "quick_filters",
-		OrderBy:       "newest",
-		MinSalePrice:  int(*minPrice),
-		MaxSalePrice:  int(*maxPrice),
-		Latitude:      location.Latitude,
-		Longitude:     location.Longitude,
-		Language:      "es_ES",
-	}
-	res, err := walla.Search(walla.SearchOpts{Age: 30 * 24 * time.Hour}, &req)
+
+	ctx := context.Background()
+	var client walla.Client = walla.HTTPClient{}
+	location, err := client.GetLocation(ctx, *locationName)
 	if err != nil {
 		log.Fatal(err)
 	}
-	resJSON, _ := json.MarshalIndent(res, "", "  ")
-	fmt.Printf("%s\n", resJSON)
+	if len(keywords) == 0 {
+		keywords = listFlag{""}
+	}
+	var res walla.ResSearch
+	seen := make(map[string]bool)
+	for _, keyword := range keywords {
+		req := walla.ReqSearch{
+			Distance:      walla.KmToMeters(int(*locationRadius)),
+			Keywords:      keyword,
+			FiltersSource: "quick_filters",
+			OrderBy:       "newest",
+			MinSalePrice:  int(*minPrice),
+			Latitude:      location.Latitude,
+			Longitude:     location.Longitude,
+			Language:      *language,
+		}
+		if *maxPrice != 0 {
+			maxSalePrice := int(*maxPrice)
+			req.MaxSalePrice = &maxSalePrice
+		}
+		keywordRes, err := client.Search(ctx, walla.SearchOpts{Age: *age}, &req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, object := range keywordRes.SearchObjects {
+			if seen[object.ID] || object.IsIgnored(ignores) {
+				continue
+			}
+			seen[object.ID] = true
+			res.SearchObjects = append(res.SearchObjects, object)
+		}
+	}
+	switch *format {
+	case "json":
+		resJSON, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Printf("%s\n", resJSON)
+	case "table":
+		printTable(&res)
+	case "short":
+		printShort(&res)
+	}
 
 	// for i, object := range res.SearchObjects {
 	// 	fmt.Printf("=== (%d) %s ===\n", i, object.ID)
@@ -1,83 +1,496 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/Dhole/wallapop-rss/walla"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
+// Build information, set at build time with e.g.
+// -ldflags "-X main.version=v1.0.0 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
 type FileWatch struct {
 	Changed bool
 	Error   error
 }
 
+const (
+	// watchInterval is the interval between the checks of the watched file.
+	watchInterval = 4 * time.Second
+	// maxWatchFailures is the number of consecutive failed checks of the
+	// watched file after which it stops being watched.
+	maxWatchFailures = 10
+	// maxWatchBackoff caps the interval between the checks of a watched file
+	// that can't be read.
+	maxWatchBackoff = 16 * watchInterval
+)
+
 // watchFile spawns a goroutine that watches the file in filePath and notifies
-// about changes via the returned channel.
-func watchFile(filePath string) (chan FileWatch, error) {
+// about changes via the returned channel, which is closed once ctx is done.
+func watchFile(ctx context.Context, filePath string) (chan FileWatch, error) {
+	return watchFileEvery(ctx, filePath, watchInterval, maxWatchFailures)
+}
+
+// watchFileEvery is watchFile checking the file every interval.  The checks
+// that fail are notified and back off, doubling the interval up to 16 times
+// it, and after maxFailures in a row the channel is closed.
+func watchFileEvery(ctx context.Context, filePath string, interval time.Duration,
+	maxFailures int) (chan FileWatch, error) {
 	saveStat, err := os.Stat(filePath)
 	if err != nil {
 		return nil, err
 	}
 	notifications := make(chan FileWatch)
 	go func() {
+		defer close(notifications)
+		// wait waits for delay and returns false if ctx is done first.
+		wait := func(delay time.Duration) bool {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return false
+			case <-timer.C:
+				return true
+			}
+		}
+		// notify returns false if ctx is done before watch is received.
+		notify := func(watch FileWatch) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case notifications <- watch:
+				return true
+			}
+		}
+		failures := 0
 		for {
 			stat, err := os.Stat(filePath)
 			if err != nil {
-				notifications <- FileWatch{Changed: false, Error: err}
+				failures++
+				if !notify(FileWatch{Changed: false, Error: err}) || failures >= maxFailures {
+					return
+				}
+				delay := interval
+				for i := 1; i < failures && delay < 16*interval; i++ {
+					delay *= 2
+				}
+				if !wait(delay) {
+					return
+				}
 				continue
 			}
+			failures = 0
 
 			if stat.Size() != saveStat.Size() || stat.ModTime() != saveStat.ModTime() {
 				saveStat = stat
-				notifications <- FileWatch{Changed: true, Error: nil}
+				if !notify(FileWatch{Changed: true, Error: nil}) {
+					return
+				}
 				continue
 			}
 
-			time.Sleep(4 * time.Second)
+			if !wait(interval) {
+				return
+			}
 		}
 	}()
 	return notifications, nil
 }
 
+// envName returns the environment variable that overrides the default of the
+// flag name, e.g. WALLA_CACHE_TIMEOUT for cacheTimeout.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString("WALLA_")
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setFlagsFromEnv sets the flags of fs from their environment variables.  It
+// must be called before parsing so that explicit flags take precedence.
+func setFlagsFromEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %v: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// checkQueries loads and validates the queries file in path, writing a report
+// to w.  It returns the exit status: 0 if the file is valid and 1 otherwise.
+func checkQueries(w io.Writer, path string) int {
+	queries, err := walla.NewQueries(path)
+	var validationErr *walla.ValidationError
+	if errors.As(err, &validationErr) {
+		fmt.Fprintf(w, "%v: %v invalid queries\n", path, len(validationErr.Problems))
+		for _, problem := range validationErr.Problems {
+			fmt.Fprintf(w, "  %v\n", problem)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(w, "%v: %v\n", path, err)
+		return 1
+	}
+	names := make([]string, 0, len(queries.Get()))
+	for name := range queries.Get() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%v: %v valid queries: %v\n", path, len(names), strings.Join(names, ", "))
+	return 0
+}
+
+// selfTestSearch is the search of the -selftest mode: kindles in Madrid.
+var selfTestSearch = walla.ReqSearch{
+	Distance:      5000,
+	Keywords:      "kindle",
+	FiltersSource: "quick_filters",
+	OrderBy:       "newest",
+	Latitude:      40.41678,
+	Longitude:     -3.70379,
+	Language:      walla.DefaultLanguage,
+}
+
+// selfTest checks that the requests are signed as expected and that client
+// can search, writing a report to w.  It returns the exit status: 0 if
+// everything works and 1 otherwise.
+func selfTest(ctx context.Context, w io.Writer, client walla.Client) int {
+	status := 0
+	if err := walla.CheckSigning(); err != nil {
+		fmt.Fprintf(w, "signing: FAILED: %v\n", err)
+		status = 1
+	} else if walla.CustomSigning() {
+		fmt.Fprintf(w, "signing: custom scheme, only checked by the search\n")
+	} else {
+		fmt.Fprintf(w, "signing: ok\n")
+	}
+	req := selfTestSearch
+	res, err := client.Search(ctx, walla.SearchOpts{FirstPageOnly: true}, &req)
+	var httpErr *walla.HTTPError
+	switch {
+	case err == nil:
+		fmt.Fprintf(w, "search: ok, %v results\n", len(res.SearchObjects))
+		return status
+	case errors.Is(err, walla.ErrBotChallenge):
+		fmt.Fprintf(w, "search: FAILED: %v\n", err)
+		fmt.Fprintf(w, "  Wallapop is blocking this IP with an anti-bot page, try later or use -proxy\n")
+	case errors.As(err, &httpErr):
+		body := httpErr.Body
+		if len(body) > 200 {
+			body = body[:200] + "..."
+		}
+		fmt.Fprintf(w, "search: FAILED: http status code %v: %q\n", httpErr.StatusCode, body)
+		if httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden {
+			fmt.Fprintf(w, "  the API rejected the request, its signing scheme may have changed\n")
+		} else if httpErr.StatusCode == http.StatusNotFound {
+			fmt.Fprintf(w, "  the search endpoint may have moved\n")
+		}
+	default:
+		fmt.Fprintf(w, "search: FAILED: %v\n", err)
+	}
+	return 1
+}
+
+// isFlagSet returns whether the flag name of fs was set to a value other than
+// its default, either in the command line or in the environment.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	f := fs.Lookup(name)
+	return f != nil && f.Value.String() != f.DefValue
+}
+
+// cacheCleanInterval returns the interval of the -cacheCleanInterval minutes,
+// which can't be negative.  Zero is the default interval.
+func cacheCleanInterval(minutes int64) (time.Duration, error) {
+	if minutes < 0 {
+		return 0, fmt.Errorf("-cacheCleanInterval %v is negative", minutes)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// jitterFraction returns the fraction of the update intervals they are
+// randomized by for the -updateJitter percent, which must be in [0, 100).
+func jitterFraction(percent float64) (float64, error) {
+	if percent < 0 || percent >= 100 {
+		return 0, fmt.Errorf("-updateJitter %v is not in [0, 100)", percent)
+	}
+	return percent / 100, nil
+}
+
+// logFormatter returns the logrus formatter of the log format: text or json.
+func logFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// splitList splits the comma-separated list s, dropping the empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// runOnce finishes the single update of the -once mode by waiting for the
+// notifications to be sent.  It returns the exit status, 1 if any feed failed.
+func runOnce(feeds *walla.Feeds) int {
+	status := 0
+	for _, s := range feeds.Status() {
+		if s.LastError != "" {
+			status = 1
+		}
+	}
+	feeds.WaitNotifications()
+	return status
+}
+
 func main() {
-	addr := flag.String("addr", "127.0.0.1:8080", "http listening address")
+	os.Exit(run())
+}
+
+// run runs the program and returns its exit status, after its deferred
+// cleanups, e.g. closing the database.
+func run() int {
+	addr := flag.String("addr", "127.0.0.1:8080", "http listening address (host:port or unix:/path/to.sock)")
+	basePath := flag.String("basePath", "", "path prefix of all the http routes, e.g. /wallapop")
+	corsOrigins := flag.String("corsOrigins", "",
+		"comma-separated origins allowed to fetch the feeds from a browser, * for any (CORS disabled if empty)")
 	debug := flag.Bool("debug", false, "enable debug logs")
+	logFormat := flag.String("logFormat", "text", "log format: text or json")
+	check := flag.Bool("check", false, "validate the queries file and exit")
+	signFormat := flag.String("signFormat", walla.DefaultSignFormat,
+		"message signed to authenticate the requests to the wallapop API, with {method}, {path} and {timestamp}")
+	signKey := flag.String("signKey", "", "HMAC key of the request signatures (built-in key if empty)")
+	signQuery := flag.Bool("signQuery", false, "sign the sorted query string of the requests along with their path")
+	selftest := flag.Bool("selftest", false,
+		"check the request signing and a search against the wallapop API and exit")
+	once := flag.Bool("once", false, "update the feeds once and exit without serving http")
+	outputDir := flag.String("outputDir", "", "directory where the RSS of every feed is written after every update (disabled if empty)")
 	queriesPath := flag.String("queries", "./queries.toml", "queries file path")
 	cacheTimeoutHours := flag.Int64("cacheTimeout", 12, "timeout for the item cache (hours)")
-	updateQueryDelaySeconds := flag.Int64("updateDelay", 1, "delay between concurrent query updates (seconds)")
-	updateIntervalMinutes := flag.Int64("updateInterval", 15, "interval between query updates (minutes)")
+	cacheCleanMinutes := flag.Int64("cacheCleanInterval", 10,
+		"interval between the removals of the expired items from the item cache (minutes)")
+	updateConcurrency := flag.Int("updateConcurrency", 2, "maximum number of concurrent query updates")
+	// Replaced by -updateConcurrency, kept so that the existing invocations
+	// still work.
+	flag.Int64("updateDelay", 0, "deprecated and ignored, use -updateConcurrency instead")
+	itemConcurrency := flag.Int("itemConcurrency", walla.DefaultItemConcurrency,
+		"maximum number of concurrent item detail requests of every query update")
+	updateIntervalMinutes := flag.Int64("updateInterval", 15, "interval between query updates unless set by the query (minutes)")
+	updateJitterPercent := flag.Float64("updateJitter", 10,
+		"randomize every query update interval by up to this percentage, below 100")
+	updateTimeoutMinutes := flag.Int64("updateTimeout", 5, "timeout for a single query update (minutes)")
+	httpTimeoutSeconds := flag.Int64("httpTimeout", 15, "timeout for the requests to the wallapop API (seconds)")
+	httpRateLimit := flag.Float64("httpRateLimit", 0,
+		"maximum requests per second of every client IP to the http endpoints (0 disables the limit)")
+	httpRateBurst := flag.Int("httpRateBurst", 10, "requests a client IP can make at once above -httpRateLimit")
+	incrementalSearch := flag.Bool("incrementalSearch", false,
+		"only fetch the search pages newer than the previous update")
+	seenPath := flag.String("seenFile", "", "file where the seen items are persisted (disabled if empty)")
+	telegramToken := flag.String("telegramToken", "", "telegram bot token used to notify new items")
+	smtpAddr := flag.String("smtpAddr", "", "SMTP server host:port used to email new items")
+	smtpUser := flag.String("smtpUser", "", "SMTP username")
+	smtpPassword := flag.String("smtpPassword", "", "SMTP password")
+	smtpFrom := flag.String("smtpFrom", "", "sender address of the new items emails")
+	dbPath := flag.String("db", "", "sqlite database where the found items are recorded (disabled if empty)")
+	trustedProxies := flag.String("trustedProxies", "127.0.0.1,::1",
+		"comma-separated IPs or CIDRs of the proxies whose X-Forwarded-For header is trusted")
+	tlsCert := flag.String("tlsCert", "", "TLS certificate file, enables https together with -tlsKey")
+	tlsKey := flag.String("tlsKey", "", "TLS private key file")
+	tlsDomain := flag.String("tlsDomain", "", "domain to get a Let's Encrypt certificate for, enables https")
+	tlsCacheDir := flag.String("tlsCacheDir", "./autocert", "directory where the Let's Encrypt certificates are stored")
+	apiKey := flag.String("apiKey", "",
+		"key required by /search in the X-API-Key header or the key parameter (no key if empty)")
+	feedAuthorName := flag.String("feedAuthorName", walla.DefaultFeedAuthorName, "author name of the feeds")
+	feedAuthorEmail := flag.String("feedAuthorEmail", walla.DefaultFeedAuthorEmail, "author email of the feeds")
+	feedLink := flag.String("feedLink", walla.DefaultFeedLink, "link of the feeds")
+	images := flag.Bool("images", true, "include the item images in the feeds of the queries that don't set include_images")
+	cookies := flag.Bool("cookies", true, "keep the cookies set by the wallapop API across requests")
+	proxy := flag.String("proxy", "",
+		"http, https or socks5 proxy URL of the requests to the wallapop API (HTTP_PROXY/HTTPS_PROXY if empty)")
+	breakerFailures := flag.Int("breakerFailures", walla.DefaultBreakerFailures,
+		"consecutive failed requests to the wallapop API that stop the requests for -breakerCooldown (0 disables it)")
+	breakerCooldownSeconds := flag.Int64("breakerCooldown", int64(walla.DefaultBreakerCooldown/time.Second),
+		"time without requests to the wallapop API after -breakerFailures (seconds)")
+	pprofListen := flag.String("pprof", "",
+		"localhost address to serve the net/http/pprof profiles on, e.g. localhost:6060 (disabled if empty)")
+	rateLimit := flag.Float64("rateLimit", walla.DefaultRateLimit,
+		"maximum requests per second to the wallapop API (0 disables the limit)")
+	searchRateLimit := flag.Float64("searchRateLimit", walla.DefaultSearchRateLimit,
+		"maximum requests per second of the /search feeds to the wallapop API, within -rateLimit (0 for only -rateLimit)")
+	if err := setFlagsFromEnv(flag.CommandLine); err != nil {
+		panic(err)
+	}
 	flag.Parse()
 
 	cacheTimeout := time.Duration(*cacheTimeoutHours) * time.Hour
-	updateQueryDelay := time.Duration(*updateQueryDelaySeconds) * time.Second
 	updateInterval := time.Duration(*updateIntervalMinutes) * time.Minute
+	updateTimeout := time.Duration(*updateTimeoutMinutes) * time.Minute
+	httpTimeout := time.Duration(*httpTimeoutSeconds) * time.Second
 
+	cacheClean, err := cacheCleanInterval(*cacheCleanMinutes)
+	if err != nil {
+		panic(err)
+	}
+	updateJitter, err := jitterFraction(*updateJitterPercent)
+	if err != nil {
+		panic(err)
+	}
+
+	if *check {
+		return checkQueries(os.Stdout, *queriesPath)
+	}
+
+	formatter, err := logFormatter(*logFormat)
+	if err != nil {
+		panic(err)
+	}
+	log.SetFormatter(formatter)
+	if isFlagSet(flag.CommandLine, "updateDelay") {
+		log.Warn("-updateDelay is deprecated and ignored, use -updateConcurrency instead")
+	}
 	if *debug {
 		log.SetLevel(log.DebugLevel)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	walla.SetHTTPTimeout(httpTimeout)
+	walla.SetRateLimit(*rateLimit)
+	walla.SetSearchRateLimit(*searchRateLimit)
+	walla.SetCookies(*cookies)
+	walla.SetCircuitBreaker(*breakerFailures, time.Duration(*breakerCooldownSeconds)*time.Second)
+	if err := walla.SetProxy(*proxy); err != nil {
+		panic(err)
+	}
+	if err := walla.SetSigning(*signFormat, *signKey); err != nil {
+		panic(err)
+	}
+	walla.SetSignQuery(*signQuery)
+	if *selftest {
+		return selfTest(context.Background(), os.Stdout, walla.HTTPClient{})
 	}
 
+	log.WithFields(log.Fields{"version": version, "commit": commit, "date": date}).
+		Info("Starting wallapop-rss")
 	log.Info("Loading queries file for the first time...")
 	queries, err := walla.NewQueries(*queriesPath)
 	if err != nil {
 		panic(err)
 	}
-	queriesUpdate, err := watchFile(*queriesPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		// A second signal kills the process if the shutdown hangs.
+		signal.Stop(signals)
+		log.Info("Shutting down...")
+		cancel()
+	}()
+	queriesUpdate, err := watchFile(ctx, *queriesPath)
 	if err != nil {
 		panic(err)
 	}
 
+	notifiers := []walla.Notifier{walla.NewWebhookNotifier()}
+	if *telegramToken != "" {
+		notifiers = append(notifiers, walla.NewTelegramNotifier(walla.NewTelegramBot(*telegramToken)))
+	}
+	if *smtpAddr != "" {
+		notifiers = append(notifiers, walla.NewEmailNotifier(walla.SMTPConfig{
+			Addr:     *smtpAddr,
+			Username: *smtpUser,
+			Password: *smtpPassword,
+			From:     *smtpFrom,
+		}))
+	}
+
+	var store walla.Store
+	if *dbPath != "" {
+		sqliteStore, err := walla.OpenSQLiteStore(*dbPath)
+		if err != nil {
+			panic(err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	}
+
+	myFeeds := walla.NewFeeds(queries, walla.FeedsConfig{
+		CacheTimeout:       cacheTimeout,
+		CacheCleanInterval: cacheClean,
+		UpdateInterval:     updateInterval,
+		UpdateJitter:       updateJitter,
+		UpdateConcurrency:  *updateConcurrency,
+		ItemConcurrency:    *itemConcurrency,
+		UpdateTimeout:      updateTimeout,
+		Notifiers:          notifiers,
+		SeenPath:           *seenPath,
+		Store:              store,
+		FeedAuthorName:     *feedAuthorName,
+		FeedAuthorEmail:    *feedAuthorEmail,
+		FeedLink:           *feedLink,
+		NoImages:           !*images,
+		OutputDir:          *outputDir,
+		IncrementalSearch:  *incrementalSearch,
+	})
+	if err := myFeeds.LoadSeen(); err != nil {
+		panic(err)
+	}
+	log.Info("Updating queries feeds for the first time...")
+	myFeeds.Update(ctx)
+	if *once {
+		return runOnce(myFeeds)
+	}
+
 	go func() {
-		for {
-			update := <-queriesUpdate
+		for update := range queriesUpdate {
 			if update.Error != nil {
 				log.WithField("file", queriesPath).WithError(update.Error).
 					Error("Failed watching queries file")
 				continue
 			}
+			old := queries.Get()
 			if err := queries.Load(); err != nil {
 				log.WithField("file", queriesPath).WithError(err).
 					Error("Failed parsing queries file")
@@ -85,44 +498,59 @@ func main() {
 			}
 			log.WithField("file", queriesPath).
 				Info("updated queries feeds")
+			myFeeds.UpdateChanged(ctx, old)
+		}
+		if ctx.Err() == nil {
+			log.WithField("file", *queriesPath).
+				Error("Stopped watching queries file after repeated failures, restart to reload it")
 		}
 	}()
-
-	myFeeds := walla.NewFeeds(queries, walla.FeedsConfig{
-		CacheTimeout:     cacheTimeout,
-		UpdateQueryDelay: updateQueryDelay,
-	})
-	log.Info("Updating queries feeds for the first time...")
-	myFeeds.Update()
-
+	running := make(chan struct{})
 	go func() {
-		for {
-			time.Sleep(updateInterval)
-			myFeeds.Update()
-		}
+		defer close(running)
+		myFeeds.Run(ctx)
 	}()
 
-	r := gin.Default()
-	r.GET("/rss/:name", func(c *gin.Context) {
-		name := c.Param("name")
-		feed, err := myFeeds.Get(name)
-		if err != nil {
-			log.WithError(err).WithField("name", name).Error("Unable to get feed")
-			c.JSON(404, gin.H{
-				"error": err,
-			})
-			return
-		}
-		rss, err := feed.ToRss()
+	srv := &server{
+		feeds:       myFeeds,
+		store:       store,
+		apiKey:      *apiKey,
+		basePath:    *basePath,
+		corsOrigins: splitList(*corsOrigins),
+		debug:       *debug,
+	}
+	if *httpRateLimit > 0 {
+		srv.limiters = newClientLimiters(*httpRateLimit, *httpRateBurst)
+	}
+	r := srv.router()
+	if err := r.SetTrustedProxies(splitList(*trustedProxies)); err != nil {
+		panic(err)
+	}
+	if *pprofListen != "" {
+		pprofListenAddr, err := pprofAddr(*pprofListen)
 		if err != nil {
-			log.WithError(err).WithField("name", name).Error("Unable build rss feed")
-			c.JSON(404, gin.H{
-				"error": err,
-			})
-			return
+			panic(err)
 		}
-		c.Data(200, "application/xml", []byte(rss))
-	})
+		log.WithField("addr", pprofListenAddr).Info("Serving pprof")
+		go func() {
+			if err := serve(ctx, pprofHandler(), pprofListenAddr, tlsConfig{}); err != nil {
+				log.WithError(err).Error("Failed serving pprof")
+			}
+		}()
+	}
 	log.WithField("addr", *addr).Info("Serving http")
-	r.Run(*addr)
+	if err := serve(ctx, r, *addr, tlsConfig{
+		Cert:     *tlsCert,
+		Key:      *tlsKey,
+		Domain:   *tlsDomain,
+		CacheDir: *tlsCacheDir,
+	}); err != nil {
+		log.WithError(err).Error("Failed serving http")
+		cancel()
+		<-running
+		return 1
+	}
+	// Wait for the feeds updates and notifications in progress to stop.
+	<-running
+	return 0
 }
@@ -1,15 +1,210 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/Dhole/wallapop-rss/walla"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestSign(t *testing.T) {
-	url := "/api/v3/suggesters/search"
-	method := "get"
-	timestamp := "1565827270558"
-	sig := sign(url, method, timestamp)
-	assert.Equal(t, "6iU/x0HyEqX2dzMTdv1QsTtBX4Z8tZTuHJmhzMXnxuU=", sig)
+func TestSetFlagsFromEnv(t *testing.T) {
+	assert.Equal(t, "WALLA_ADDR", envName("addr"))
+	assert.Equal(t, "WALLA_CACHE_TIMEOUT", envName("cacheTimeout"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "")
+	cacheTimeout := fs.Int64("cacheTimeout", 12, "")
+	debug := fs.Bool("debug", false, "")
+	os.Setenv("WALLA_ADDR", "0.0.0.0:80")
+	os.Setenv("WALLA_CACHE_TIMEOUT", "6")
+	os.Setenv("WALLA_DEBUG", "true")
+	defer os.Unsetenv("WALLA_ADDR")
+	defer os.Unsetenv("WALLA_CACHE_TIMEOUT")
+	defer os.Unsetenv("WALLA_DEBUG")
+
+	require.Nil(t, setFlagsFromEnv(fs))
+	require.Nil(t, fs.Parse([]string{"-cacheTimeout", "1"}))
+	assert.Equal(t, "0.0.0.0:80", *addr)
+	assert.Equal(t, int64(1), *cacheTimeout)
+	assert.True(t, *debug)
+
+	os.Setenv("WALLA_CACHE_TIMEOUT", "six")
+	assert.Error(t, setFlagsFromEnv(fs))
+}
+
+func TestLogFormatter(t *testing.T) {
+	formatter, err := logFormatter("text")
+	require.Nil(t, err)
+	assert.IsType(t, &log.TextFormatter{}, formatter)
+	formatter, err = logFormatter("json")
+	require.Nil(t, err)
+	assert.IsType(t, &log.JSONFormatter{}, formatter)
+	_, err = logFormatter("xml")
+	assert.Error(t, err)
+}
+
+func TestCheckQueries(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.toml")
+	require.Nil(t, ioutil.WriteFile(valid, []byte(`
+[psvita]
+keywords = ["ps vita"]
+location_name = "Barcelona"
+location_radius = 5
+
+[kindle]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+`), 0644))
+	invalid := filepath.Join(dir, "invalid.toml")
+	require.Nil(t, ioutil.WriteFile(invalid, []byte(`
+[kindle]
+keywords = ["kindle"]
+location_radius = 5
+`), 0644))
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, checkQueries(&out, valid))
+	assert.Equal(t, valid+": 2 valid queries: kindle, psvita\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 1, checkQueries(&out, invalid))
+	assert.Equal(t, invalid+": 1 invalid queries\n"+
+		`  query "kindle": no location_name nor coordinates`+"\n", out.String())
+
+	out.Reset()
+	assert.Equal(t, 1, checkQueries(&out, filepath.Join(dir, "missing.toml")))
+}
+
+// searchErrClient is a walla.Client whose searches fail with err.
+type searchErrClient struct {
+	emptyClient
+	err error
+}
+
+func (c searchErrClient) Search(ctx context.Context, opts walla.SearchOpts, req *walla.ReqSearch) (*walla.ResSearch, error) {
+	return nil, c.err
+}
+
+func TestSelfTest(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 0, selfTest(context.Background(), &out, emptyClient{}))
+	assert.Equal(t, "signing: ok\nsearch: ok, 0 results\n", out.String())
+
+	for err, expected := range map[error]string{
+		fmt.Errorf("searching: %w", walla.ErrBotChallenge): "search: FAILED: searching: blocked by an anti-bot challenge\n" +
+			"  Wallapop is blocking this IP with an anti-bot page, try later or use -proxy\n",
+		&walla.HTTPError{StatusCode: 401, Body: `{"error": "bad signature"}`}: "search: FAILED: " +
+			`http status code 401: "{\"error\": \"bad signature\"}"` + "\n" +
+			"  the API rejected the request, its signing scheme may have changed\n",
+		errors.New("dial tcp: no route to host"): "search: FAILED: dial tcp: no route to host\n",
+	} {
+		out.Reset()
+		assert.Equal(t, 1, selfTest(context.Background(), &out, searchErrClient{err: err}))
+		assert.Equal(t, "signing: ok\n"+expected, out.String())
+	}
+
+	require.Nil(t, walla.SetSigning("{method}|{path}|{timestamp}", ""))
+	defer walla.SetSigning("", "")
+	out.Reset()
+	assert.Equal(t, 0, selfTest(context.Background(), &out, emptyClient{}))
+	assert.Equal(t, "signing: custom scheme, only checked by the search\nsearch: ok, 0 results\n", out.String())
+}
+
+func TestWatchFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	_, err := watchFile(context.Background(), path)
+	assert.True(t, os.IsNotExist(err))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("a"), 0644))
+	interval := 10 * time.Millisecond
+	updates, err := watchFileEvery(context.Background(), path, interval, 3)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, []byte("ab"), 0644))
+	assert.Equal(t, FileWatch{Changed: true}, <-updates)
+
+	require.Nil(t, os.Remove(path))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		update, ok := <-updates
+		require.True(t, ok)
+		assert.True(t, os.IsNotExist(update.Error))
+	}
+	_, ok := <-updates
+	assert.False(t, ok, "stops after repeated failures")
+	// Backs off after the first and second failures.
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(3*interval))
+}
+
+func TestWatchFileStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte("a"), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := watchFileEvery(ctx, path, time.Hour, 3)
+	require.Nil(t, err)
+	cancel()
+	_, ok := <-updates
+	assert.False(t, ok, "stops once ctx is done")
+
+	// Not even waiting for a change to be received.
+	ctx, cancel = context.WithCancel(context.Background())
+	updates, err = watchFileEvery(ctx, path, time.Millisecond, 3)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, []byte("ab"), 0644))
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for range updates {
+	}
+}
+
+func TestJitterFraction(t *testing.T) {
+	fraction, err := jitterFraction(10)
+	require.Nil(t, err)
+	assert.Equal(t, 0.1, fraction)
+	fraction, err = jitterFraction(0)
+	require.Nil(t, err)
+	assert.Equal(t, 0.0, fraction)
+	for _, percent := range []float64{-1, 100, 200} {
+		_, err := jitterFraction(percent)
+		assert.Error(t, err, percent)
+	}
+}
+
+func TestIsFlagSet(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int64("updateDelay", 0, "")
+	fs.Int("updateConcurrency", 2, "")
+	require.Nil(t, fs.Parse([]string{"-updateDelay", "1"}))
+	assert.True(t, isFlagSet(fs, "updateDelay"))
+	assert.False(t, isFlagSet(fs, "updateConcurrency"))
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int64("updateDelay", 0, "")
+	os.Setenv("WALLA_UPDATE_DELAY", "2")
+	defer os.Unsetenv("WALLA_UPDATE_DELAY")
+	require.Nil(t, setFlagsFromEnv(fs))
+	assert.True(t, isFlagSet(fs, "updateDelay"))
+}
+
+func TestCacheCleanInterval(t *testing.T) {
+	interval, err := cacheCleanInterval(10)
+	require.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, interval)
+	interval, err = cacheCleanInterval(0)
+	require.Nil(t, err)
+	assert.Equal(t, time.Duration(0), interval)
+	_, err = cacheCleanInterval(-1)
+	assert.EqualError(t, err, "-cacheCleanInterval -1 is negative")
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterIdle is how long the limiter of a client is kept after its last
+// request.
+const clientLimiterIdle = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters keeps a token bucket per client IP.
+type clientLimiters struct {
+	m         sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+func newClientLimiters(requestsPerSecond float64, burst int) *clientLimiters {
+	if burst < 1 {
+		burst = 1
+	}
+	return &clientLimiters{
+		limit:   rate.Limit(requestsPerSecond),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// reserve takes a token of the client ip at now.  It returns 0 if allowed, or
+// how long to wait for the next token otherwise.
+func (l *clientLimiters) reserve(ip string, now time.Time) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if now.Sub(l.lastPrune) > clientLimiterIdle {
+		for ip, client := range l.clients {
+			if now.Sub(client.lastSeen) > clientLimiterIdle {
+				delete(l.clients, ip)
+			}
+		}
+		l.lastPrune = now
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	r := client.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// rateLimit replies 429 with a Retry-After header to the clients that exceed
+// their rate of requests.
+func rateLimit(limiters *clientLimiters) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if delay := limiters.reserve(c.ClientIP(), time.Now()); delay > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientLimiters(t *testing.T) {
+	limiters := newClientLimiters(1, 2)
+	now := time.Now()
+	assert.Zero(t, limiters.reserve("1.1.1.1", now))
+	assert.Zero(t, limiters.reserve("1.1.1.1", now))
+	assert.Equal(t, time.Second, limiters.reserve("1.1.1.1", now))
+	// Every client has its own bucket.
+	assert.Zero(t, limiters.reserve("2.2.2.2", now))
+	// A rejected request doesn't take a token.
+	assert.Zero(t, limiters.reserve("1.1.1.1", now.Add(time.Second)))
+
+	// Idle clients are pruned.
+	limiters.reserve("3.3.3.3", now.Add(2*clientLimiterIdle))
+	assert.Len(t, limiters.clients, 1)
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := testServer()
+	srv.limiters = newClientLimiters(0.5, 1)
+	r := srv.router()
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+		return w
+	}
+	assert.Equal(t, http.StatusOK, get().Code)
+	w := get()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	srv := testServer()
+	srv.limiters = newClientLimiters(0.5, 1)
+	r := srv.router()
+	require.NoError(t, r.SetTrustedProxies([]string{"10.0.0.1"}))
+
+	get := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	// The header of a trusted proxy tells the clients apart.
+	assert.Equal(t, http.StatusOK, get("10.0.0.1:1234", "1.1.1.1"))
+	assert.Equal(t, http.StatusOK, get("10.0.0.1:1234", "2.2.2.2"))
+	assert.Equal(t, http.StatusTooManyRequests, get("10.0.0.1:1234", "1.1.1.1"))
+	// The header of any other client is ignored.
+	assert.Equal(t, http.StatusOK, get("3.3.3.3:1234", "4.4.4.4"))
+	assert.Equal(t, http.StatusTooManyRequests, get("3.3.3.3:1234", "5.5.5.5"))
+}
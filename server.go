@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dhole/wallapop-rss/walla"
+	"github.com/gin-contrib/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/feeds"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// server serves the feeds over http.
+type server struct {
+	feeds *walla.Feeds
+	// store is nil when the items are not recorded.
+	store walla.Store
+	// apiKey is required by the live searches unless empty.
+	apiKey string
+	// basePath prefixes all the routes, e.g. "/wallapop".
+	basePath string
+	// corsOrigins are the origins allowed to fetch the feeds from a browser,
+	// "*" allows any origin.  CORS is disabled if empty.
+	corsOrigins []string
+	// limiters limit the rate of requests of every client, no limit if nil.
+	limiters *clientLimiters
+	// debug serves /debug/search without an API key.  With an API key it's
+	// always served, requiring the key.
+	debug bool
+}
+
+// normalizeBasePath returns path with a leading slash and without a trailing
+// one, or empty for the root.
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// errInvalidSearch is the error of a /search request with invalid parameters.
+var errInvalidSearch = errors.New("invalid search")
+
+// errorStatus returns the http status code to reply with for err.  Only a
+// missing feed or item history is reported as not found, upstream errors are
+// reported as a bad gateway, or as unavailable while the circuit breaker is
+// open, and anything else is an internal error, except for invalid search
+// parameters.
+func errorStatus(err error) int {
+	if errors.Is(err, errInvalidSearch) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, walla.ErrFeedNotFound) || errors.Is(err, walla.ErrHistoryNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, walla.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	var httpErr *walla.HTTPError
+	if errors.As(err, &httpErr) || errors.Is(err, walla.ErrBotChallenge) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// replyError replies with a JSON body containing the error message.  The error
+// value itself is not serialized because it usually marshals to `{}`.
+func replyError(c *gin.Context, err error) {
+	c.JSON(errorStatus(err), gin.H{
+		"error": err.Error(),
+	})
+}
+
+// router returns the http handler with all the routes of the server.
+func (s *server) router() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(accessLog())
+	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	g := r.Group(normalizeBasePath(s.basePath))
+	if s.limiters != nil {
+		g.Use(rateLimit(s.limiters))
+	}
+	if len(s.corsOrigins) > 0 {
+		g.Use(cors(s.corsOrigins))
+	}
+	g.GET("/", s.getIndex)
+	g.GET("/favicon.ico", getFavicon)
+	g.GET("/rss/:name", s.getRss)
+	g.GET("/status", s.getStatus)
+	g.GET("/version", getVersion)
+	g.GET("/cache/stats", s.getCacheStats)
+	g.GET("/breaker", getBreaker)
+	g.GET("/search", s.requireAPIKey, s.getSearch)
+	if s.debug || s.apiKey != "" {
+		g.GET("/debug/search", s.requireAPIKey, s.getDebugSearch)
+	}
+	if s.store != nil {
+		g.GET("/history/:itemID", s.getHistory)
+	}
+	return r
+}
+
+// accessLog logs every request with its feed name, status and latency.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		entry := log.WithFields(log.Fields{
+			"method":  c.Request.Method,
+			"path":    c.Request.URL.Path,
+			"status":  c.Writer.Status(),
+			"latency": time.Since(start),
+			"client":  c.ClientIP(),
+		})
+		if name := c.Param("name"); name != "" {
+			entry = entry.WithField("name", name)
+		}
+		entry.Info("HTTP request")
+	}
+}
+
+// cors sets the Access-Control-Allow-Origin header for the requests from one
+// of the allowed origins.
+func cors(origins []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Vary", "Origin")
+		origin := c.GetHeader("Origin")
+		for _, allowed := range origins {
+			if allowed == "*" {
+				c.Header("Access-Control-Allow-Origin", "*")
+				break
+			}
+			if origin != "" && allowed == origin {
+				c.Header("Access-Control-Allow-Origin", origin)
+				break
+			}
+		}
+		c.Next()
+	}
+}
+
+// indexTemplate is the page that links to every feed.
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Wallapop RSS</title>
+<link rel="icon" type="image/svg+xml" href="{{.BasePath}}/favicon.ico">
+</head>
+<body>
+<h1>Wallapop RSS</h1>
+<ul>
+{{- range .Feeds}}
+{{- if .URL}}
+<li><a href="{{.URL}}">{{.Name}}</a> ({{.Items}} items)</li>
+{{- else}}
+<li>{{.Name}} (not generated yet)</li>
+{{- end}}
+{{- else}}
+<li>No feeds</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// indexFeed is a feed listed in the index page.
+type indexFeed struct {
+	Name string
+	// URL is empty until the feed is generated.
+	URL   string
+	Items int
+}
+
+func (s *server) getIndex(c *gin.Context) {
+	basePath := normalizeBasePath(s.basePath)
+	var feeds []indexFeed
+	for _, status := range s.feeds.Status() {
+		feed := indexFeed{Name: status.Name, Items: status.Items}
+		// The feeds that never updated successfully don't exist yet.
+		if !status.LastUpdated.IsZero() {
+			feed.URL = basePath + "/rss/" + url.PathEscape(status.Name)
+		}
+		feeds = append(feeds, feed)
+	}
+	var page bytes.Buffer
+	err := indexTemplate.Execute(&page, struct {
+		BasePath string
+		Feeds    []indexFeed
+	}{basePath, feeds})
+	if err != nil {
+		log.WithError(err).Error("Unable to render the index page")
+		replyError(c, err)
+		return
+	}
+	c.Data(200, "text/html; charset=utf-8", page.Bytes())
+}
+
+// favicon is the icon of the index page, the RSS symbol on Wallapop green.
+const favicon = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16">` +
+	`<rect width="16" height="16" rx="3" fill="#13c1ac"/>` +
+	`<circle cx="4.5" cy="11.5" r="1.5" fill="#fff"/>` +
+	`<path d="M3 7a6 6 0 0 1 6 6M3 3a10 10 0 0 1 10 10" stroke="#fff" stroke-width="2" fill="none"/>` +
+	`</svg>`
+
+func getFavicon(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(200, "image/svg+xml", []byte(favicon))
+}
+
+func (s *server) getRss(c *gin.Context) {
+	name := c.Param("name")
+	rss, err := s.feeds.GetRSS(name)
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("Unable to get feed")
+		replyError(c, err)
+		return
+	}
+	c.Data(200, "application/xml", withSelfLink(rss, requestURL(c)))
+}
+
+// replyFeed replies with feed in RSS format.
+func replyFeed(c *gin.Context, feed *feeds.Feed) {
+	rss, err := walla.ToRSS(feed)
+	if err != nil {
+		log.WithError(err).Error("Unable build rss feed")
+		replyError(c, err)
+		return
+	}
+	c.Data(200, "application/xml", withSelfLink([]byte(rss), requestURL(c)))
+}
+
+// requestURL returns the absolute URL of the request.  The scheme and host
+// given by a trusted proxy in X-Forwarded-Proto and X-Forwarded-Host are used
+// instead of the ones of the request.
+func requestURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	if _, trusted := c.RemoteIP(); trusted {
+		// The first values are the ones of the proxy closest to the client.
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(c.GetHeader("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := strings.TrimSpace(strings.Split(c.GetHeader("X-Forwarded-Host"), ",")[0]); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return fmt.Sprintf("%v://%v%v", scheme, host, c.Request.URL.RequestURI())
+}
+
+// withSelfLink returns rss with an atom:link to href with rel="self" in its
+// channel, as recommended by the feed validators.
+func withSelfLink(rss []byte, href string) []byte {
+	channel := bytes.Index(rss, []byte("<channel>"))
+	if channel < 0 {
+		return rss
+	}
+	channel += len("<channel>")
+	var link bytes.Buffer
+	link.WriteString(`<atom:link href="`)
+	xml.EscapeText(&link, []byte(href))
+	link.WriteString(`" rel="self" type="application/rss+xml"></atom:link>`)
+	head := bytes.Replace(rss[:channel], []byte("<rss "),
+		[]byte(`<rss xmlns:atom="http://www.w3.org/2005/Atom" `), 1)
+	res := make([]byte, 0, len(head)+link.Len()+len(rss)-channel)
+	res = append(res, head...)
+	res = append(res, link.Bytes()...)
+	return append(res, rss[channel:]...)
+}
+
+// requireAPIKey rejects the requests without s.apiKey in the X-API-Key header
+// or the key parameter, unless s.apiKey is empty.
+func (s *server) requireAPIKey(c *gin.Context) {
+	if s.apiKey == "" {
+		return
+	}
+	key := c.GetHeader("X-API-Key")
+	if key == "" {
+		key = c.Query("key")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.apiKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+	}
+}
+
+// searchQuery returns the query of a /search request.
+func searchQuery(c *gin.Context) (*walla.Query, error) {
+	query := walla.Query{
+		Keywords:       c.QueryArray("keyword"),
+		Ignores:        c.QueryArray("ignore"),
+		LocationName:   c.Query("location"),
+		LocationRadius: 5,
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{
+		{"radius", &query.LocationRadius},
+		{"minPrice", &query.MinPrice},
+		{"maxPrice", &query.MaxPrice},
+	} {
+		raw := c.Query(param.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v is not an integer", errInvalidSearch, param.name)
+		}
+		*param.value = value
+	}
+	if err := query.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSearch, err)
+	}
+	return &query, nil
+}
+
+func (s *server) getSearch(c *gin.Context) {
+	query, err := searchQuery(c)
+	if err != nil {
+		replyError(c, err)
+		return
+	}
+	feed, err := s.feeds.SearchFeed(c.Request.Context(), query)
+	if err != nil {
+		log.WithError(err).WithField("keywords", query.Keywords).Error("Unable to search")
+		replyError(c, err)
+		return
+	}
+	replyFeed(c, feed)
+}
+
+// getDebugSearch replies with the raw response of the Wallapop API to the first
+// page of a search with the /search parameters, and the request sent.
+func (s *server) getDebugSearch(c *gin.Context) {
+	query, err := searchQuery(c)
+	if err != nil {
+		replyError(c, err)
+		return
+	}
+	res, err := s.feeds.DebugSearch(c.Request.Context(), query)
+	if err != nil {
+		log.WithError(err).WithField("keywords", query.Keywords).Error("Unable to debug search")
+		replyError(c, err)
+		return
+	}
+	c.JSON(200, res)
+}
+
+func (s *server) getStatus(c *gin.Context) {
+	c.JSON(200, s.feeds.Status())
+}
+
+func (s *server) getCacheStats(c *gin.Context) {
+	c.JSON(200, s.feeds.CacheStats())
+}
+
+func getBreaker(c *gin.Context) {
+	c.JSON(200, walla.Breaker())
+}
+
+func getVersion(c *gin.Context) {
+	c.JSON(200, gin.H{"version": version, "commit": commit, "date": date})
+}
+
+func (s *server) getHistory(c *gin.Context) {
+	itemID := c.Param("itemID")
+	history, err := s.store.History(c.Request.Context(), itemID)
+	if err != nil {
+		log.WithError(err).WithField("itemID", itemID).Error("Unable to get item history")
+		replyError(c, err)
+		return
+	}
+	c.JSON(200, history)
+}
+
+// tlsConfig selects how https is served.  Domain takes precedence over Cert
+// and Key, and plain http is served when all of them are empty.
+type tlsConfig struct {
+	Cert string
+	Key  string
+	// Domain enables certificates from Let's Encrypt for this domain, stored
+	// in CacheDir.
+	Domain   string
+	CacheDir string
+}
+
+// listen listens on addr, which is either host:port or unix:/path/to.sock.
+func listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// Remove the socket left by an unclean exit, but no other file.
+		if fi, err := os.Lstat(path); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%v exists and is not a unix socket", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve serves handler on addr until ctx is done.  Unix socket files are
+// removed when the server stops.
+func serve(ctx context.Context, handler http.Handler, addr string, cfg tlsConfig) error {
+	if cfg.Domain == "" && (cfg.Cert == "") != (cfg.Key == "") {
+		return fmt.Errorf("both a TLS certificate and key are required")
+	}
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	switch {
+	case cfg.Domain != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.Domain),
+			Cache:      autocert.DirCache(cfg.CacheDir),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		err = srv.ServeTLS(l, "", "")
+	case cfg.Cert != "":
+		err = srv.ServeTLS(l, cfg.Cert, cfg.Key)
+	default:
+		err = srv.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// pprofHandler returns the handler of the net/http/pprof profiles, served
+// apart from the feeds.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// pprofAddr returns the address the profiles are served on for addr, which
+// must be a localhost one so that they are not public.  An address without a
+// host is on localhost.
+func pprofAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid pprof address %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("pprof address %q is not a localhost one", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
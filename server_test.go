@@ -0,0 +1,422 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dhole/wallapop-rss/walla"
+	"github.com/gin-gonic/gin"
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer() *server {
+	return &server{feeds: walla.NewFeeds(&walla.Queries{}, walla.FeedsConfig{})}
+}
+
+func TestErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, errorStatus(walla.ErrFeedNotFound))
+	assert.Equal(t, http.StatusNotFound, errorStatus(walla.ErrHistoryNotFound))
+	assert.Equal(t, http.StatusBadGateway,
+		errorStatus(&walla.HTTPError{StatusCode: 404}))
+	assert.Equal(t, http.StatusBadGateway,
+		errorStatus(fmt.Errorf("searching: %w", walla.ErrBotChallenge)))
+	assert.Equal(t, http.StatusServiceUnavailable,
+		errorStatus(fmt.Errorf("searching: %w", walla.ErrCircuitOpen)))
+	assert.Equal(t, http.StatusBadGateway,
+		errorStatus(fmt.Errorf("searching: %w", &walla.HTTPError{StatusCode: 503})))
+	assert.Equal(t, http.StatusBadRequest,
+		errorStatus(fmt.Errorf("%w: no keywords", errInvalidSearch)))
+	assert.Equal(t, http.StatusInternalServerError,
+		errorStatus(errors.New("rendering failed")))
+}
+
+func TestReplyError(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	replyError(c, walla.ErrFeedNotFound)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "feed not found"}`, w.Body.String())
+}
+
+func TestSearchAPIKey(t *testing.T) {
+	srv := testServer()
+	srv.apiKey = "secret"
+	r := srv.router()
+	for _, target := range []string{"/search?keyword=kindle", "/search?keyword=kindle&key=wrong"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, target)
+		assert.JSONEq(t, `{"error": "invalid API key"}`, w.Body.String(), target)
+	}
+	// Authorized, so the parameters are validated.
+	req := httptest.NewRequest("GET", "/search?location=Barcelona", nil)
+	req.Header.Set("X-API-Key", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDebugSearchGated(t *testing.T) {
+	get := func(srv *server, target string) int {
+		w := httptest.NewRecorder()
+		srv.router().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+	// The parameters are only validated when served and authorized.
+	assert.Equal(t, http.StatusNotFound, get(testServer(), "/debug/search"))
+	srv := testServer()
+	srv.debug = true
+	assert.Equal(t, http.StatusBadRequest, get(srv, "/debug/search"))
+	srv = testServer()
+	srv.apiKey = "secret"
+	assert.Equal(t, http.StatusUnauthorized, get(srv, "/debug/search"))
+	assert.Equal(t, http.StatusBadRequest, get(srv, "/debug/search?key=secret"))
+}
+
+func TestSearchInvalidParams(t *testing.T) {
+	r := testServer().router()
+	for target, expected := range map[string]string{
+		"/search?keyword=kindle&location=Barcelona&radius=abc": "invalid search: radius is not an integer",
+		"/search?keyword=kindle":                               "invalid search: no location_name nor coordinates",
+		"/search?keyword=kindle&location=Barcelona&minPrice=50&maxPrice=10": "invalid search: " +
+			"min_price (50) is greater than max_price (10)",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.JSONEq(t, fmt.Sprintf(`{"error": %q}`, expected), w.Body.String(), target)
+	}
+}
+
+func TestWithSelfLink(t *testing.T) {
+	feed := gfeeds.Feed{Title: "kindle", Link: &gfeeds.Link{Href: walla.DefaultFeedLink}}
+	rss, err := feed.ToRss()
+	require.Nil(t, err)
+	withLink := withSelfLink([]byte(rss), "http://example.com/rss/kindle?a=1&b=2")
+
+	var parsed struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Links []struct {
+				XMLName xml.Name
+				Href    string `xml:"href,attr"`
+				Rel     string `xml:"rel,attr"`
+				Text    string `xml:",chardata"`
+			} `xml:"link"`
+		} `xml:"channel"`
+	}
+	require.Nil(t, xml.Unmarshal(withLink, &parsed))
+	assert.Equal(t, "kindle", parsed.Channel.Title)
+	require.Len(t, parsed.Channel.Links, 2)
+	assert.Equal(t, "http://www.w3.org/2005/Atom", parsed.Channel.Links[0].XMLName.Space)
+	assert.Equal(t, "http://example.com/rss/kindle?a=1&b=2", parsed.Channel.Links[0].Href)
+	assert.Equal(t, "self", parsed.Channel.Links[0].Rel)
+	assert.Equal(t, walla.DefaultFeedLink, parsed.Channel.Links[1].Text)
+	// The original rendering is not modified.
+	assert.NotContains(t, rss, "atom")
+}
+
+func TestRequestURL(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "http://rss.example.com:8080/rss/kindle?x=1", nil)
+	assert.Equal(t, "http://rss.example.com:8080/rss/kindle?x=1", requestURL(c))
+	c.Request = httptest.NewRequest("GET", "https://rss.example.com/rss/kindle", nil)
+	assert.Equal(t, "https://rss.example.com/rss/kindle", requestURL(c))
+}
+
+func TestRequestURLForwarded(t *testing.T) {
+	c, r := gin.CreateTestContext(httptest.NewRecorder())
+	require.Nil(t, r.SetTrustedProxies([]string{"10.0.0.1"}))
+	forwarded := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "http://internal:8080/rss/kindle", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "rss.example.com, internal")
+		return req
+	}
+	c.Request = forwarded("10.0.0.1:1234")
+	assert.Equal(t, "https://rss.example.com/rss/kindle", requestURL(c))
+	// Only trusted proxies can set them.
+	c.Request = forwarded("192.0.2.1:1234")
+	assert.Equal(t, "http://internal:8080/rss/kindle", requestURL(c))
+}
+
+func TestBasePath(t *testing.T) {
+	for _, path := range []string{"", "/"} {
+		assert.Equal(t, "", normalizeBasePath(path))
+	}
+	for _, path := range []string{"wallapop", "/wallapop", "/wallapop/"} {
+		assert.Equal(t, "/wallapop", normalizeBasePath(path))
+	}
+
+	srv := testServer()
+	srv.basePath = "/wallapop/"
+	r := srv.router()
+	for target, status := range map[string]int{
+		"/wallapop/status":      http.StatusOK,
+		"/status":               http.StatusNotFound,
+		"/wallapop/rss/missing": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, status, w.Code, target)
+	}
+}
+
+// emptyClient is a walla.Client that finds nothing.
+type emptyClient struct{}
+
+func (emptyClient) Search(ctx context.Context, opts walla.SearchOpts, req *walla.ReqSearch) (*walla.ResSearch, error) {
+	return &walla.ResSearch{}, nil
+}
+
+func (emptyClient) GetItem(ctx context.Context, itemID string) (*walla.ResItem, error) {
+	return nil, errors.New("no items")
+}
+
+func (emptyClient) GetItems(ctx context.Context, itemIDs []string) ([]*walla.ResItem, error) {
+	if len(itemIDs) == 0 {
+		return nil, nil
+	}
+	return nil, errors.New("no items")
+}
+
+func (emptyClient) GetLocation(ctx context.Context, place string) (*walla.ResMapsHerePlace, error) {
+	return nil, errors.New("no locations")
+}
+
+func (emptyClient) GetUserStats(ctx context.Context, userID string) (*walla.ResUserStats, error) {
+	return nil, errors.New("no users")
+}
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+["ps vita"]
+keywords = ["ps vita"]
+latitude = 41.38
+longitude = 2.17
+location_radius = 5
+
+[failing]
+keywords = ["psp"]
+location_name = "Nowhere"
+location_radius = 5
+`), 0644))
+	queries, err := walla.NewQueries(path)
+	require.Nil(t, err)
+	srv := &server{feeds: walla.NewFeeds(queries, walla.FeedsConfig{Client: emptyClient{}})}
+	srv.feeds.Update(context.Background())
+	srv.basePath = "/wallapop"
+	r := srv.router()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/wallapop/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<a href="/wallapop/rss/ps%20vita">ps vita</a> (0 items)`)
+	assert.Contains(t, w.Body.String(), `href="/wallapop/favicon.ico"`)
+	// The feeds not generated yet aren't linked.
+	assert.Contains(t, w.Body.String(), `<li>failing (not generated yet)</li>`)
+	assert.NotContains(t, w.Body.String(), `/wallapop/rss/failing`)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/wallapop/favicon.ico", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	testServer().router().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "No feeds")
+}
+
+func TestVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	testServer().router().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var res map[string]string
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, map[string]string{"version": "dev", "commit": "none", "date": "unknown"}, res)
+}
+
+func TestCacheStats(t *testing.T) {
+	w := httptest.NewRecorder()
+	testServer().router().ServeHTTP(w, httptest.NewRequest("GET", "/cache/stats", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hits": 0, "misses": 0, "size": 0, "evictions": 0}`, w.Body.String())
+}
+
+func TestBreaker(t *testing.T) {
+	w := httptest.NewRecorder()
+	testServer().router().ServeHTTP(w, httptest.NewRequest("GET", "/breaker", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"state": "closed", "consecutive_failures": 0, "opened_at": "0001-01-01T00:00:00Z"}`,
+		w.Body.String())
+}
+
+func TestCORS(t *testing.T) {
+	get := func(srv *server, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		srv.router().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	srv := testServer()
+	w := get(srv, "https://reader.example.com")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	srv.corsOrigins = []string{"https://reader.example.com"}
+	w = get(srv, "https://reader.example.com")
+	assert.Equal(t, "https://reader.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	w = get(srv, "https://other.example.com")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	srv.corsOrigins = []string{"*"}
+	w = get(srv, "https://other.example.com")
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestGzip(t *testing.T) {
+	r := testServer().router()
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(w.Body)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(zr)
+	require.Nil(t, err)
+	assert.Equal(t, "[]", string(body))
+}
+
+func TestServeTLSRequiresCertAndKey(t *testing.T) {
+	err := serve(context.Background(), testServer().router(), "127.0.0.1:0",
+		tlsConfig{Cert: "cert.pem"})
+	assert.EqualError(t, err, "both a TLS certificate and key are required")
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "walla.sock")
+	// A stale socket file is replaced.
+	stale, err := net.Listen("unix", path)
+	require.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serve(ctx, testServer().router(), "unix:"+path, tlsConfig{}) }()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client.Get("http://unix/status"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	require.Nil(t, <-done)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServeUnixSocketNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte("[kindle]"), 0600))
+
+	err := serve(context.Background(), testServer().router(), "unix:"+path, tlsConfig{})
+	assert.EqualError(t, err, path+" exists and is not a unix socket")
+	content, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "[kindle]", string(content))
+}
+
+func TestAccessLog(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	r := testServer().router()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/rss/kindle", nil))
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "HTTP request" {
+			entry = e
+		}
+	}
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "GET", entry.Data["method"])
+	assert.Equal(t, "/rss/kindle", entry.Data["path"])
+	assert.Equal(t, "kindle", entry.Data["name"])
+	assert.Equal(t, http.StatusNotFound, entry.Data["status"])
+	assert.Contains(t, entry.Data, "latency")
+}
+
+func TestPprofAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr     string
+		expected string
+	}{
+		{":6060", "localhost:6060"},
+		{"localhost:6060", "localhost:6060"},
+		{"127.0.0.1:6060", "127.0.0.1:6060"},
+		{"[::1]:6060", "[::1]:6060"},
+	} {
+		addr, err := pprofAddr(test.addr)
+		require.Nil(t, err, test.addr)
+		assert.Equal(t, test.expected, addr)
+	}
+	for _, addr := range []string{"0.0.0.0:6060", "example.com:6060", "6060"} {
+		_, err := pprofAddr(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		pprofHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+	// The profiles are not served with the feeds.
+	srv := &server{feeds: walla.NewFeeds(&walla.Queries{}, walla.FeedsConfig{})}
+	w := httptest.NewRecorder()
+	srv.router().ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,149 @@
+package walla
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBreakerFailures is the default number of consecutive failed
+	// requests to the Wallapop API that open the circuit breaker.
+	DefaultBreakerFailures = 10
+	// DefaultBreakerCooldown is the default time the circuit breaker stays
+	// open before letting a request probe the Wallapop API.
+	DefaultBreakerCooldown = time.Minute
+)
+
+// ErrCircuitOpen is returned instead of sending a request to the Wallapop API
+// while the circuit breaker is open, after too many consecutive failures.
+var ErrCircuitOpen = errors.New("circuit breaker open after repeated wallapop API failures")
+
+// The states of the circuit breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerStatus is the state of the circuit breaker of the Wallapop API.
+type BreakerStatus struct {
+	// State is BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// OpenedAt is the time of the last failure that opened the breaker,
+	// zero if closed.
+	OpenedAt time.Time `json:"opened_at"`
+}
+
+// circuitBreaker rejects the requests after maxFailures consecutive failures.
+// Once cooldown has passed since the last failure a single request probes the
+// API: its success closes the breaker and its failure opens it again.
+type circuitBreaker struct {
+	m           sync.Mutex
+	maxFailures int
+	cooldown    time.Duration
+	failures    int
+	openedAt    time.Time
+	probing     bool
+}
+
+// breaker guards all the requests to the Wallapop API.
+var breaker = &circuitBreaker{maxFailures: DefaultBreakerFailures, cooldown: DefaultBreakerCooldown}
+
+// SetCircuitBreaker sets the number of consecutive failed requests to the
+// Wallapop API that open the circuit breaker, and how long it stays open.  A
+// non-positive number of failures disables the breaker.
+func SetCircuitBreaker(failures int, cooldown time.Duration) {
+	breaker.m.Lock()
+	defer breaker.m.Unlock()
+	breaker.maxFailures = failures
+	breaker.cooldown = cooldown
+	breaker.failures = 0
+	breaker.openedAt = time.Time{}
+	breaker.probing = false
+}
+
+// Breaker returns the state of the circuit breaker of the Wallapop API.
+func Breaker() BreakerStatus {
+	return breaker.status(time.Now())
+}
+
+func (b *circuitBreaker) open() bool {
+	return b.maxFailures > 0 && b.failures >= b.maxFailures
+}
+
+// allow returns ErrCircuitOpen if a request can't be sent at now, and
+// whether the request is the one probing the API.  Every allowed request must
+// be followed by a call to done.
+func (b *circuitBreaker) allow(now time.Time) (bool, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.open() {
+		return false, nil
+	}
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false, ErrCircuitOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// isFailure returns whether err shows that the API is failing.  The requests
+// rejected with a client error other than 429, e.g. 404 for a removed listing
+// or 400 for a bad search, got an answer from the API.
+func isFailure(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return err != nil
+}
+
+// done records at now the result err of an allowed request sent with ctx,
+// probe as returned by allow.  The requests cancelled by their caller are not
+// counted.
+func (b *circuitBreaker) done(ctx context.Context, probe bool, err error, now time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if !isFailure(err) {
+		if b.open() {
+			log.Info("Wallapop API circuit breaker closed")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		return
+	}
+	b.failures++
+	if b.open() {
+		if b.failures == b.maxFailures {
+			log.WithError(err).WithField("cooldown", b.cooldown).
+				Warn("Wallapop API circuit breaker opened")
+		}
+		b.openedAt = now
+	}
+}
+
+func (b *circuitBreaker) status(now time.Time) BreakerStatus {
+	b.m.Lock()
+	defer b.m.Unlock()
+	status := BreakerStatus{State: BreakerClosed, ConsecutiveFailures: b.failures}
+	if b.open() {
+		status.OpenedAt = b.openedAt
+		status.State = BreakerOpen
+		if !b.probing && now.Sub(b.openedAt) >= b.cooldown {
+			status.State = BreakerHalfOpen
+		}
+	}
+	return status
+}
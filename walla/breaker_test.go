@@ -0,0 +1,199 @@
+package walla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request sends a request through b at now that ends with err.
+func request(t *testing.T, b *circuitBreaker, ctx context.Context, err error, now time.Time) {
+	probe, allowErr := b.allow(now)
+	require.Nil(t, allowErr)
+	b.done(ctx, probe, err, now)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{maxFailures: 2, cooldown: time.Minute}
+	ctx := context.Background()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := &HTTPError{StatusCode: http.StatusServiceUnavailable}
+
+	for i := 0; i < 2; i++ {
+		request(t, b, ctx, failure, now)
+	}
+	assert.Equal(t, BreakerStatus{State: BreakerOpen, ConsecutiveFailures: 2, OpenedAt: now}, b.status(now))
+	_, err := b.allow(now.Add(30 * time.Second))
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// A single request probes the API after the cooldown, and its failure
+	// opens the breaker again.
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, b.status(now).State)
+	probe, err := b.allow(now)
+	require.Nil(t, err)
+	assert.True(t, probe)
+	_, err = b.allow(now)
+	assert.Equal(t, ErrCircuitOpen, err)
+	b.done(ctx, probe, failure, now)
+	_, err = b.allow(now.Add(time.Second))
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	// Its success closes it.
+	now = now.Add(time.Minute)
+	request(t, b, ctx, nil, now)
+	assert.Equal(t, BreakerStatus{State: BreakerClosed}, b.status(now))
+
+	// The requests cancelled by their caller are not failures.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		request(t, b, cancelled, context.Canceled, now)
+	}
+	assert.Equal(t, BreakerStatus{State: BreakerClosed}, b.status(now))
+
+	// Disabled.
+	b = &circuitBreaker{}
+	for i := 0; i < 3; i++ {
+		request(t, b, ctx, failure, now)
+	}
+	assert.Equal(t, BreakerClosed, b.status(now).State)
+}
+
+func TestCircuitBreakerFailures(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, err := range []error{
+		errors.New("doing http request: connection refused"),
+		fmt.Errorf("%w (http status code is 403)", ErrBotChallenge),
+		&HTTPError{StatusCode: http.StatusTooManyRequests},
+		&HTTPError{StatusCode: http.StatusInternalServerError},
+	} {
+		b := &circuitBreaker{maxFailures: 2, cooldown: time.Minute}
+		for i := 0; i < 2; i++ {
+			request(t, b, ctx, err, now)
+		}
+		assert.Equal(t, BreakerOpen, b.status(now).State, err)
+	}
+
+	// The removed listings and the bad searches don't open it.
+	for _, err := range []error{
+		&HTTPError{StatusCode: http.StatusNotFound},
+		&HTTPError{StatusCode: http.StatusBadRequest},
+	} {
+		b := &circuitBreaker{maxFailures: 2, cooldown: time.Minute}
+		for i := 0; i < 3; i++ {
+			request(t, b, ctx, err, now)
+		}
+		assert.Equal(t, BreakerStatus{State: BreakerClosed}, b.status(now), err)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := &circuitBreaker{maxFailures: 1, cooldown: time.Minute}
+	ctx := context.Background()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := &HTTPError{StatusCode: http.StatusServiceUnavailable}
+
+	// A request in flight when the breaker opens.
+	inFlight, err := b.allow(now)
+	require.Nil(t, err)
+	request(t, b, ctx, failure, now)
+
+	now = now.Add(time.Minute)
+	probe, err := b.allow(now)
+	require.Nil(t, err)
+	assert.True(t, probe)
+	// It ends after the probe is sent, which stays the only one.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	b.done(cancelled, inFlight, context.Canceled, now)
+	_, err = b.allow(now)
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, BreakerOpen, b.status(now).State)
+
+	b.done(ctx, probe, nil, now)
+	assert.Equal(t, BreakerStatus{State: BreakerClosed}, b.status(now))
+}
+
+func TestGetCircuitBreaker(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+	SetCircuitBreaker(2, time.Hour)
+	defer SetCircuitBreaker(DefaultBreakerFailures, DefaultBreakerCooldown)
+
+	for i := 0; i < 3; i++ {
+		_, err := GetParamsString(context.Background(), srv.URL, "", &struct{}{})
+		require.Error(t, err)
+	}
+	_, err := GetParamsString(context.Background(), srv.URL, "", &struct{}{})
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, BreakerOpen, Breaker().State)
+}
+
+func TestGetRateLimitNotFailure(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	SetRateLimit(0.001)
+	defer SetRateLimit(DefaultRateLimit)
+	SetCircuitBreaker(2, time.Hour)
+	defer SetCircuitBreaker(DefaultBreakerFailures, DefaultBreakerCooldown)
+
+	// Takes the burst of the limiter.
+	for limiter.Allow() {
+	}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := GetParamsString(ctx, srv.URL, "", &struct{}{})
+		cancel()
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	assert.Equal(t, 0, requests)
+	assert.Equal(t, BreakerStatus{State: BreakerClosed}, Breaker())
+
+	SetRateLimit(0)
+	_, err := GetParamsString(context.Background(), srv.URL, "", &struct{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestSearchRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+	SetSearchRateLimit(0.001)
+	defer SetSearchRateLimit(DefaultSearchRateLimit)
+
+	// Takes the burst of the search limiter.
+	for searchLimiter.Allow() {
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := GetParamsString(onDemand(ctx), srv.URL, "", &struct{}{})
+	assert.Contains(t, err.Error(), "waiting for search rate limiter")
+	// The feed updates aren't limited by it.
+	_, err = GetParamsString(ctx, srv.URL, "", &struct{}{})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,55 @@
+package walla
+
+import "context"
+
+// Client queries the Wallapop API.
+type Client interface {
+	Search(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error)
+	GetItem(ctx context.Context, itemID string) (*ResItem, error)
+	// GetItems returns the details of the items itemIDs, in the same order,
+	// nil for the items that no longer exist.  On error the items fetched
+	// until then may be returned along with it.
+	GetItems(ctx context.Context, itemIDs []string) ([]*ResItem, error)
+	GetLocation(ctx context.Context, place string) (*ResMapsHerePlace, error)
+	GetUserStats(ctx context.Context, userID string) (*ResUserStats, error)
+}
+
+// DefaultItemConcurrency is the default maximum number of item details
+// fetched at the same time by HTTPClient.GetItems.
+const DefaultItemConcurrency = 4
+
+// HTTPClient is the Client that sends the http requests of Search, GetItem,
+// GetItems, GetLocation and GetUserStats.
+type HTTPClient struct {
+	// ItemConcurrency is the maximum number of item details fetched at the
+	// same time by GetItems, DefaultItemConcurrency if zero.
+	ItemConcurrency int
+}
+
+var _ Client = HTTPClient{}
+
+func (HTTPClient) Search(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+	return Search(ctx, opts, req)
+}
+
+func (HTTPClient) GetItem(ctx context.Context, itemID string) (*ResItem, error) {
+	return GetItem(ctx, itemID)
+}
+
+// GetItems fetches every item with its own request, as the API has no
+// endpoint to get several items at once.
+func (c HTTPClient) GetItems(ctx context.Context, itemIDs []string) ([]*ResItem, error) {
+	concurrency := c.ItemConcurrency
+	if concurrency == 0 {
+		concurrency = DefaultItemConcurrency
+	}
+	return GetItems(ctx, itemIDs, concurrency)
+}
+
+func (HTTPClient) GetLocation(ctx context.Context, place string) (*ResMapsHerePlace, error) {
+	return GetLocation(ctx, place)
+}
+
+func (HTTPClient) GetUserStats(ctx context.Context, userID string) (*ResUserStats, error) {
+	return GetUserStats(ctx, userID)
+}
@@ -0,0 +1,72 @@
+package walla
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTPConfig is the configuration of the SMTP server used to send emails.
+type SMTPConfig struct {
+	// Addr is the host:port of the SMTP server.
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// EmailNotifier sends a digest email with the new items of a feed update to
+// the email_to addresses of its query.
+type EmailNotifier struct {
+	cfg SMTPConfig
+	// sendMail is smtp.SendMail except in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewEmailNotifier(cfg SMTPConfig) *EmailNotifier {
+	return &EmailNotifier{cfg: cfg, sendMail: smtp.SendMail}
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, query *Query, items []NewItem) error {
+	if query.EmailTo == "" {
+		return nil
+	}
+	to, err := mail.ParseAddressList(query.EmailTo)
+	if err != nil {
+		return fmt.Errorf("parsing email_to: %w", err)
+	}
+	recipients := make([]string, 0, len(to))
+	for _, address := range to {
+		recipients = append(recipients, address.Address)
+	}
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(n.cfg.Addr)
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, host)
+	}
+	if err := n.sendMail(n.cfg.Addr, auth, n.cfg.From, recipients,
+		emailMessage(n.cfg.From, query.EmailTo, items)); err != nil {
+		return fmt.Errorf("sending email: %w", err)
+	}
+	return nil
+}
+
+// emailMessage formats items as a plain text email with the title (which
+// includes the price) and the link of each item.
+func emailMessage(from, to string, items []NewItem) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", from)
+	fmt.Fprintf(&b, "To: %v\r\n", to)
+	fmt.Fprintf(&b, "Subject: %v new items in %v\r\n", len(items), items[0].Feed)
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	for _, item := range items {
+		fmt.Fprintf(&b, "%v\r\n%v\r\n\r\n", item.Title, item.URL)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,37 @@
+package walla
+
+import (
+	"context"
+	"net/smtp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailNotifier(t *testing.T) {
+	notifier := NewEmailNotifier(SMTPConfig{Addr: "smtp.example.com:587", From: "rss@example.com"})
+	var sent [][]string
+	var msgs []string
+	notifier.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		assert.Equal(t, "smtp.example.com:587", addr)
+		assert.Equal(t, "rss@example.com", from)
+		sent = append(sent, to)
+		msgs = append(msgs, string(msg))
+		return nil
+	}
+	items := []NewItem{
+		{Feed: "kindle", Title: "Kindle - 50 EUR", URL: "https://es.wallapop.com/item/kindle-1"},
+		{Feed: "kindle", Title: "Kindle Oasis - 90 EUR", URL: "https://es.wallapop.com/item/kindle-2"},
+	}
+
+	require.Nil(t, notifier.Notify(context.Background(), &Query{}, items))
+	assert.Empty(t, sent)
+
+	require.Nil(t, notifier.Notify(context.Background(),
+		&Query{EmailTo: "Me <me@example.com>, you@example.com"}, items))
+	assert.Equal(t, [][]string{{"me@example.com", "you@example.com"}}, sent)
+	assert.Contains(t, msgs[0], "Subject: 2 new items in kindle\r\n")
+	assert.Contains(t, msgs[0], "\r\n\r\nKindle - 50 EUR\r\nhttps://es.wallapop.com/item/kindle-1\r\n\r\n"+
+		"Kindle Oasis - 90 EUR\r\nhttps://es.wallapop.com/item/kindle-2\r\n")
+}
@@ -0,0 +1,140 @@
+package walla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/feeds"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWebhookTimeout    = 10 * time.Second
+	DefaultWebhookRetries    = 3
+	DefaultWebhookRetryDelay = 5 * time.Second
+)
+
+// NewItem is a listing that appeared in a feed since its previous update.
+type NewItem struct {
+	Feed    string    `json:"feed"`
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	URL     string    `json:"url"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+func newItems(feedName string, items []*feeds.Item) []NewItem {
+	res := make([]NewItem, 0, len(items))
+	for _, item := range items {
+		newItem := NewItem{
+			Feed:    feedName,
+			ID:      item.Id,
+			Title:   item.Title,
+			Created: item.Created,
+		}
+		if item.Link != nil {
+			newItem.URL = item.Link.Href
+		}
+		if item.Author != nil {
+			newItem.Author = item.Author.Name
+		}
+		res = append(res, newItem)
+	}
+	return res
+}
+
+// Notifier is notified of the new items found in a feed update.
+type Notifier interface {
+	Notify(ctx context.Context, query *Query, items []NewItem) error
+}
+
+// notify sends the new items of a feed to all the notifiers.  Failures are
+// only logged.
+func (f *Feeds) notify(ctx context.Context, query *Query, items []NewItem) {
+	for _, notifier := range f.cfg.Notifiers {
+		if err := notifier.Notify(ctx, query, items); err != nil {
+			log.WithError(err).WithField("name", items[0].Feed).Error("Unable to notify new items")
+		}
+	}
+}
+
+// WaitNotifications waits until the notifications of the previous updates are
+// sent.
+func (f *Feeds) WaitNotifications() {
+	f.notifying.Wait()
+}
+
+// WebhookNotifier POSTs every new item as JSON to the webhook_url of its
+// query, retrying failed requests.
+type WebhookNotifier struct {
+	Client     *http.Client
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func NewWebhookNotifier() *WebhookNotifier {
+	return &WebhookNotifier{
+		Client:     &http.Client{Timeout: DefaultWebhookTimeout},
+		Retries:    DefaultWebhookRetries,
+		RetryDelay: DefaultWebhookRetryDelay,
+	}
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, query *Query, items []NewItem) error {
+	if query.WebhookURL == "" {
+		return nil
+	}
+	for _, item := range items {
+		body, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("json marshaling webhook payload: %w", err)
+		}
+		if err := w.post(ctx, query.WebhookURL, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WebhookNotifier) post(ctx context.Context, url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-time.After(w.RetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = w.postOnce(ctx, url, body); err == nil {
+			return nil
+		}
+		log.WithError(err).WithField("url", url).WithField("attempt", attempt+1).
+			Debug("Failed webhook request")
+	}
+	return fmt.Errorf("posting webhook: %w", err)
+}
+
+func (w *WebhookNotifier) postOnce(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("doing http request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return nil
+}
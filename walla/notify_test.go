@@ -0,0 +1,90 @@
+package walla
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeNotifier struct {
+	items chan []NewItem
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, query *Query, items []NewItem) error {
+	n.items <- items
+	return nil
+}
+
+func TestUpdateNotifiesNewItems(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {}}}
+	notifier := &fakeNotifier{items: make(chan []NewItem, 1)}
+	feeds := NewFeeds(&queries, FeedsConfig{Notifiers: []Notifier{notifier}})
+	ids := []string{"1", "2"}
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		feed := gfeeds.Feed{Link: &gfeeds.Link{}}
+		for _, id := range ids {
+			feed.Items = append(feed.Items, &gfeeds.Item{Id: id, Link: &gfeeds.Link{Href: "/item/" + id}})
+		}
+		return &feed, nil
+	}
+
+	feeds.Update(context.Background())
+	ids = []string{"3", "1", "2"}
+	feeds.Update(context.Background())
+
+	select {
+	case items := <-notifier.items:
+		require.Len(t, items, 1)
+		assert.Equal(t, NewItem{Feed: "kindle", ID: "3", URL: "/item/3"}, items[0])
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+	select {
+	case items := <-notifier.items:
+		t.Fatalf("unexpected notification %+v", items)
+	default:
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	var m sync.Mutex
+	var received []NewItem
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var item NewItem
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&item))
+		received = append(received, item)
+	}))
+	defer srv.Close()
+
+	notifier := NewWebhookNotifier()
+	notifier.RetryDelay = time.Millisecond
+	err := notifier.Notify(context.Background(), &Query{WebhookURL: srv.URL},
+		[]NewItem{{Feed: "kindle", ID: "1"}, {Feed: "kindle", ID: "2"}})
+	require.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []NewItem{{Feed: "kindle", ID: "1"}, {Feed: "kindle", ID: "2"}}, received)
+
+	notifier.Retries = 0
+	srvDown := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srvDown.Close()
+	err = notifier.Notify(context.Background(), &Query{WebhookURL: srvDown.URL}, []NewItem{{ID: "1"}})
+	assert.Error(t, err)
+}
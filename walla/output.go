@@ -0,0 +1,20 @@
+package walla
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// writeRSSFile writes the RSS of the feed name to dir/<name>.xml.  The file is
+// replaced atomically, so that a web server serving dir never serves a partial
+// feed.
+func writeRSSFile(dir, name string, rss []byte) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("feed %q can't be written to a file", name)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, name+".xml"), rss, 0644); err != nil {
+		return fmt.Errorf("writing rss: %w", err)
+	}
+	return nil
+}
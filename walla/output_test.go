@@ -0,0 +1,61 @@
+package walla
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	queries := Queries{queries: map[string]Query{"kindle": {}, "psp": {}}}
+	feeds := NewFeeds(&queries, FeedsConfig{OutputDir: dir})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+
+	for _, name := range []string{"kindle", "psp"} {
+		path := filepath.Join(dir, name+".xml")
+		data, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		rss, err := feeds.GetRSS(name)
+		require.Nil(t, err)
+		assert.Equal(t, rss, data)
+		info, err := os.Stat(path)
+		require.Nil(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestUpdateOutputDirError(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {}}}
+	feeds := NewFeeds(&queries, FeedsConfig{OutputDir: filepath.Join(t.TempDir(), "missing")})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+
+	// The feed is still served.
+	_, err := feeds.GetRSS("kindle")
+	assert.Nil(t, err)
+	status := feeds.Status()
+	require.Len(t, status, 1)
+	assert.Contains(t, status[0].LastError, "writing rss")
+}
+
+func TestWriteRSSFileName(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"", "..", "../kindle", `a\b`} {
+		assert.Error(t, writeRSSFile(dir, name, nil), name)
+	}
+}
@@ -0,0 +1,68 @@
+package walla
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/gorilla/feeds"
+)
+
+// mediaNamespace is the namespace of the Media RSS elements.
+const mediaNamespace = "http://search.yahoo.com/mrss/"
+
+// rssXML is feeds.RssFeedXml with the Media RSS namespace.
+type rssXML struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	MediaNamespace   string   `xml:"xmlns:media,attr,omitempty"`
+	Channel          *rssChannel
+}
+
+// rssChannel is a feeds.RssFeed whose items can have Media RSS elements.
+type rssChannel struct {
+	*feeds.RssFeed
+	Items []*rssItem `xml:"item"`
+}
+
+// rssItem is a feeds.RssItem with a Media RSS thumbnail and content.
+type rssItem struct {
+	*feeds.RssItem
+	MediaThumbnail *mediaThumbnail
+	MediaContent   *mediaContent
+}
+
+type mediaThumbnail struct {
+	XMLName xml.Name `xml:"media:thumbnail"`
+	URL     string   `xml:"url,attr"`
+}
+
+type mediaContent struct {
+	XMLName xml.Name `xml:"media:content"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Medium  string   `xml:"medium,attr"`
+}
+
+// ToRSS renders feed as RSS 2.0 like feed.ToRss, adding a Media RSS thumbnail
+// and content to the items whose enclosure is an image.  The enclosures of
+// the images have no length, so they are not rendered as such.
+func ToRSS(feed *feeds.Feed) (string, error) {
+	channel := &rssChannel{RssFeed: (&feeds.Rss{Feed: feed}).RssFeed()}
+	doc := rssXML{Version: "2.0", ContentNamespace: "http://purl.org/rss/1.0/modules/content/", Channel: channel}
+	for i, item := range channel.RssFeed.Items {
+		media := &rssItem{RssItem: item}
+		if enclosure := feed.Items[i].Enclosure; enclosure != nil && strings.HasPrefix(enclosure.Type, "image/") {
+			media.MediaThumbnail = &mediaThumbnail{URL: enclosure.Url}
+			media.MediaContent = &mediaContent{URL: enclosure.Url, Type: enclosure.Type, Medium: "image"}
+			doc.MediaNamespace = mediaNamespace
+		}
+		channel.Items = append(channel.Items, media)
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// Strip the newline of the header, like feeds.ToXML.
+	return xml.Header[:len(xml.Header)-1] + string(data), nil
+}
@@ -0,0 +1,53 @@
+package walla
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToRSS(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", Title: "Kindle", WebSlug: "kindle-1", Images: []Image{{Original: "https://cdn/1.jpg"}}},
+		{ID: "2", Title: "PS Vita", WebSlug: "ps-vita-2"},
+	}
+	items := map[string]*ResItem{"1": {ID: "1"}, "2": {ID: "2"}}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	feeds := NewFeeds(&Queries{}, FeedsConfig{})
+
+	// Without thumbnails it's rendered like gorilla/feeds does.
+	feed := feeds.buildFeed(&Query{}, objects, items, now)
+	expected, err := feed.ToRss()
+	require.Nil(t, err)
+	rss, err := ToRSS(feed)
+	require.Nil(t, err)
+	assert.Equal(t, expected, rss)
+
+	feed = feeds.buildFeed(&Query{MediaThumbnails: true}, objects, items, now)
+	rss, err = ToRSS(feed)
+	require.Nil(t, err)
+	assert.Contains(t, rss, `xmlns:media="http://search.yahoo.com/mrss/"`)
+	assert.NotContains(t, rss, "<enclosure")
+	var parsed struct {
+		Items []struct {
+			GUID      string `xml:"guid"`
+			Thumbnail struct {
+				URL string `xml:"url,attr"`
+			} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+			Content struct {
+				URL    string `xml:"url,attr"`
+				Medium string `xml:"medium,attr"`
+			} `xml:"http://search.yahoo.com/mrss/ content"`
+		} `xml:"channel>item"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(rss), &parsed))
+	require.Len(t, parsed.Items, 2)
+	assert.Equal(t, "1", parsed.Items[0].GUID)
+	assert.Equal(t, "https://cdn/1.jpg", parsed.Items[0].Thumbnail.URL)
+	assert.Equal(t, "https://cdn/1.jpg", parsed.Items[0].Content.URL)
+	assert.Equal(t, "image", parsed.Items[0].Content.Medium)
+	assert.Equal(t, "", parsed.Items[1].Thumbnail.URL)
+}
@@ -0,0 +1,134 @@
+package walla
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultUpdateInterval is the default interval between the updates of
+	// a feed.
+	DefaultUpdateInterval = 15 * time.Minute
+	// DefaultCacheCleanInterval is the default interval between the removals
+	// of the expired items from the cache.
+	DefaultCacheCleanInterval = 10 * time.Minute
+	// schedulePollInterval is the longest Run waits before looking for due
+	// feeds, so that the queries added by a reload are updated soon.
+	schedulePollInterval = time.Minute
+	// maxUpdateBackoff caps the interval between the updates of a feed that
+	// keeps failing, unless its update interval is longer.
+	maxUpdateBackoff = 4 * time.Hour
+)
+
+// updateInterval returns the interval between the updates of the feed of
+// query.
+func (f *Feeds) updateInterval(query *Query) time.Duration {
+	if query.UpdateIntervalMinutes != 0 {
+		return time.Duration(query.UpdateIntervalMinutes) * time.Minute
+	}
+	if f.cfg.UpdateInterval != 0 {
+		return f.cfg.UpdateInterval
+	}
+	return DefaultUpdateInterval
+}
+
+// cacheCleanInterval returns the interval between the removals of the
+// expired items from the cache.
+func (f *Feeds) cacheCleanInterval() time.Duration {
+	if f.cfg.CacheCleanInterval > 0 {
+		return f.cfg.CacheCleanInterval
+	}
+	return DefaultCacheCleanInterval
+}
+
+// backoff returns the interval until the next update of a feed after
+// failures consecutive failed updates: interval doubled for every failure
+// after the first one, up to maxUpdateBackoff.
+func backoff(interval time.Duration, failures int) time.Duration {
+	if interval >= maxUpdateBackoff {
+		return interval
+	}
+	for i := 1; i < failures && interval < maxUpdateBackoff; i++ {
+		interval *= 2
+	}
+	if interval > maxUpdateBackoff {
+		return maxUpdateBackoff
+	}
+	return interval
+}
+
+// maxUpdateJitter bounds cfg.UpdateJitter below 1, so that the randomized
+// intervals are never negative.
+const maxUpdateJitter = 0.99
+
+// jitter returns interval randomized by up to cfg.UpdateJitter of it, capped
+// at maxUpdateJitter.
+func (f *Feeds) jitter(interval time.Duration) time.Duration {
+	fraction := f.cfg.UpdateJitter
+	if fraction <= 0 {
+		return interval
+	}
+	if fraction > maxUpdateJitter {
+		fraction = maxUpdateJitter
+	}
+	return interval + time.Duration((2*rand.Float64()-1)*fraction*float64(interval))
+}
+
+// due returns the queries whose feed is due to be updated at now, and the
+// time the next feed is due (at most schedulePollInterval after now).  The
+// feeds never updated are due.
+func (f *Feeds) due(now time.Time) (map[string]Query, time.Time) {
+	queries := f.queries.Get()
+	due := make(map[string]Query)
+	nextDue := now.Add(schedulePollInterval)
+	f.m.RLock()
+	defer f.m.RUnlock()
+	for name, query := range queries {
+		if !query.enabled() {
+			// Passed to update to remove its feed.
+			if _, ok := f.status[name]; ok {
+				due[name] = query
+			}
+			continue
+		}
+		next, ok := f.next[name]
+		if !ok || !next.After(now) {
+			due[name] = query
+		} else if next.Before(nextDue) {
+			nextDue = next
+		}
+	}
+	return due, nextDue
+}
+
+// Run updates every feed when it's due, according to the update interval of
+// its query, and cleans the caches until ctx is done.  It returns once the
+// goroutines it started and the notifications being sent have stopped.
+func (f *Feeds) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer f.WaitNotifications()
+	for _, cache := range []*Cache{f.itemCache, f.userCache} {
+		wg.Add(1)
+		go func(cache *Cache) {
+			defer wg.Done()
+			cache.Run(ctx, f.cacheCleanInterval())
+		}(cache)
+	}
+	for ctx.Err() == nil {
+		f.prune()
+		due, nextDue := f.due(time.Now())
+		if len(due) != 0 {
+			f.update(ctx, due)
+			continue
+		}
+		timer := time.NewTimer(time.Until(nextDue))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package walla
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateInterval(t *testing.T) {
+	feeds := NewFeeds(&Queries{}, FeedsConfig{})
+	assert.Equal(t, DefaultUpdateInterval, feeds.updateInterval(&Query{}))
+	feeds = NewFeeds(&Queries{}, FeedsConfig{UpdateInterval: time.Hour})
+	assert.Equal(t, time.Hour, feeds.updateInterval(&Query{}))
+	assert.Equal(t, 5*time.Minute, feeds.updateInterval(&Query{UpdateIntervalMinutes: 5}))
+}
+
+func TestCacheCleanInterval(t *testing.T) {
+	feeds := NewFeeds(&Queries{}, FeedsConfig{})
+	assert.Equal(t, DefaultCacheCleanInterval, feeds.cacheCleanInterval())
+	feeds = NewFeeds(&Queries{}, FeedsConfig{CacheCleanInterval: time.Minute})
+	assert.Equal(t, time.Minute, feeds.cacheCleanInterval())
+	feeds = NewFeeds(&Queries{}, FeedsConfig{CacheCleanInterval: -time.Minute})
+	assert.Equal(t, DefaultCacheCleanInterval, feeds.cacheCleanInterval())
+}
+
+func TestBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		0:  15 * time.Minute,
+		1:  15 * time.Minute,
+		2:  30 * time.Minute,
+		3:  time.Hour,
+		5:  4 * time.Hour,
+		50: 4 * time.Hour,
+	} {
+		assert.Equal(t, expected, backoff(15*time.Minute, failures), failures)
+	}
+	assert.Equal(t, 6*time.Hour, backoff(6*time.Hour, 3))
+}
+
+func TestJitter(t *testing.T) {
+	feeds := NewFeeds(&Queries{}, FeedsConfig{})
+	assert.Equal(t, time.Hour, feeds.jitter(time.Hour))
+
+	feeds = NewFeeds(&Queries{}, FeedsConfig{UpdateJitter: 0.1})
+	intervals := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		interval := feeds.jitter(time.Hour)
+		assert.GreaterOrEqual(t, int64(interval), int64(54*time.Minute))
+		assert.LessOrEqual(t, int64(interval), int64(66*time.Minute))
+		intervals[interval] = true
+	}
+	assert.Greater(t, len(intervals), 1)
+
+	// Too much jitter is capped so that the intervals stay positive.
+	feeds = NewFeeds(&Queries{}, FeedsConfig{UpdateJitter: 2})
+	for i := 0; i < 1000; i++ {
+		assert.Greater(t, int64(feeds.jitter(time.Hour)), int64(0))
+	}
+}
+
+func TestRun(t *testing.T) {
+	queries := Queries{queries: map[string]Query{
+		"fast": {UpdateIntervalMinutes: 5},
+		"slow": {UpdateIntervalMinutes: 60},
+	}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	var m sync.Mutex
+	updates := make(map[string]int)
+	updated := make(chan string, 10)
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		name := "slow"
+		if query.UpdateIntervalMinutes == 5 {
+			name = "fast"
+		}
+		m.Lock()
+		updates[name]++
+		m.Unlock()
+		updated <- name
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	<-updated
+	<-updated
+
+	now := time.Now()
+	feeds.m.RLock()
+	assert.WithinDuration(t, now.Add(5*time.Minute), feeds.next["fast"], time.Second)
+	assert.WithinDuration(t, now.Add(time.Hour), feeds.next["slow"], time.Second)
+	feeds.m.RUnlock()
+	due, nextDue := feeds.due(now)
+	assert.Empty(t, due)
+	assert.Equal(t, now.Add(schedulePollInterval), nextDue)
+
+	// Only the feeds that are due are updated.
+	feeds.m.Lock()
+	feeds.next["fast"] = now.Add(-time.Second)
+	feeds.m.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		feeds.Run(ctx)
+		close(done)
+	}()
+	assert.Equal(t, "fast", <-updated)
+	cancel()
+	<-done
+	m.Lock()
+	defer m.Unlock()
+	require.Equal(t, map[string]int{"fast": 2, "slow": 1}, updates)
+}
+
+func TestUpdateBackoff(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {UpdateIntervalMinutes: 10}}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	var err error
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, err
+	}
+
+	err = errors.New("blocked")
+	for failures, interval := range []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute} {
+		feeds.Update(context.Background())
+		status := feeds.Status()
+		require.Len(t, status, 1)
+		assert.Equal(t, failures+1, status[0].ConsecutiveFailures)
+		assert.WithinDuration(t, time.Now().Add(interval), status[0].NextUpdate, time.Second)
+	}
+
+	// A successful update resets the backoff.
+	err = nil
+	feeds.Update(context.Background())
+	status := feeds.Status()
+	assert.Equal(t, 0, status[0].ConsecutiveFailures)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), status[0].NextUpdate, time.Second)
+}
+
+func TestUpdateCancelledNotFailure(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {UpdateIntervalMinutes: 10}}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	before := feeds.Status()
+	require.Len(t, before, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		// Shut down during the update.
+		cancel()
+		return nil, ctx.Err()
+	}
+	feeds.Update(ctx)
+	assert.Equal(t, before, feeds.Status())
+}
+
+// checkGoroutines fails t if the number of goroutines doesn't go back to n
+// within a second.
+func checkGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaked := runtime.NumGoroutine() - n; leaked > 0 {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%v goroutines leaked:\n%s", leaked, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	queries := Queries{queries: map[string]Query{
+		"kindle": {Keywords: []string{"kindle"}},
+		"switch": {Keywords: []string{"switch"}},
+		"ps5":    {Keywords: []string{"ps5"}},
+	}}
+	feeds := NewFeeds(&queries, FeedsConfig{UpdateConcurrency: 2, CacheCleanInterval: time.Millisecond})
+	started := make(chan string)
+	var m sync.Mutex
+	updates := 0
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		m.Lock()
+		updates++
+		m.Unlock()
+		started <- query.Keywords[0]
+		// A slow update stopped by ctx.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		feeds.Run(ctx)
+		close(done)
+	}()
+	<-started
+	<-started
+	cancel()
+	<-done
+	// The third feed is never updated once ctx is done.
+	m.Lock()
+	assert.Equal(t, 2, updates)
+	m.Unlock()
+
+	feeds.Update(ctx)
+	m.Lock()
+	assert.Equal(t, 2, updates)
+	m.Unlock()
+	checkGoroutines(t, goroutines)
+}
@@ -0,0 +1,114 @@
+package walla
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/gorilla/feeds"
+)
+
+// markSeen records the items of feed as seen and returns the ones that were
+// not seen in previous updates.  Unless firstRun is set nothing is new in the
+// first update of a feed, so that enabling notifications doesn't report all the
+// existing listings.  f.m must be held.
+func (f *Feeds) markSeen(name string, feed *feeds.Feed, firstRun bool) []*feeds.Item {
+	seen, ok := f.seen[name]
+	if !ok {
+		seen = make(map[string]bool)
+		f.seen[name] = seen
+	}
+	var items []*feeds.Item
+	for _, item := range feed.Items {
+		if seen[item.Id] {
+			continue
+		}
+		seen[item.Id] = true
+		if ok || firstRun {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// NewItems returns the items that appeared in the feed name in its latest
+// update.
+func (f *Feeds) NewItems(name string) []NewItem {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return append([]NewItem(nil), f.newItems[name]...)
+}
+
+// LoadSeen loads the item IDs seen in previous runs from cfg.SeenPath so that
+// they are not reported as new after a restart.  A missing file is not an
+// error.
+func (f *Feeds) LoadSeen() error {
+	if f.cfg.SeenPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.cfg.SeenPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var seenIDs map[string][]string
+	if err := json.Unmarshal(data, &seenIDs); err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	for name, ids := range seenIDs {
+		seen := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			seen[id] = true
+		}
+		f.seen[name] = seen
+	}
+	return nil
+}
+
+// saveSeen writes the seen item IDs to cfg.SeenPath.  The file is replaced
+// atomically so that a crash can't leave it truncated.
+func (f *Feeds) saveSeen() error {
+	f.m.RLock()
+	seenIDs := make(map[string][]string, len(f.seen))
+	for name, seen := range f.seen {
+		ids := make([]string, 0, len(seen))
+		for id := range seen {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		seenIDs[name] = ids
+	}
+	f.m.RUnlock()
+	data, err := json.Marshal(seenIDs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.cfg.SeenPath, data, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path, with permissions perm.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,51 @@
+package walla
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeenPersistence(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {}}}
+	cfg := FeedsConfig{SeenPath: filepath.Join(t.TempDir(), "seen.json")}
+	ids := []string{"1", "2"}
+	genFeed := func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		feed := gfeeds.Feed{Link: &gfeeds.Link{}}
+		for _, id := range ids {
+			feed.Items = append(feed.Items, &gfeeds.Item{Id: id, Link: &gfeeds.Link{}})
+		}
+		return &feed, nil
+	}
+
+	feeds := NewFeeds(&queries, cfg)
+	require.Nil(t, feeds.LoadSeen())
+	feeds.genFeedFn = genFeed
+	feeds.Update(context.Background())
+	assert.Empty(t, feeds.NewItems("kindle"))
+
+	// A restarted instance only reports the items that weren't seen before.
+	ids = []string{"3", "1", "2"}
+	feeds = NewFeeds(&queries, cfg)
+	require.Nil(t, feeds.LoadSeen())
+	feeds.genFeedFn = genFeed
+	feeds.Update(context.Background())
+	assert.Equal(t, []NewItem{{Feed: "kindle", ID: "3"}}, feeds.NewItems("kindle"))
+
+	feeds.Update(context.Background())
+	assert.Empty(t, feeds.NewItems("kindle"))
+}
+
+func TestSeenNotifyOnFirstRun(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {NotifyOnFirstRun: true}}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}, Items: []*gfeeds.Item{{Id: "1", Link: &gfeeds.Link{}}}}, nil
+	}
+	feeds.Update(context.Background())
+	assert.Equal(t, []NewItem{{Feed: "kindle", ID: "1"}}, feeds.NewItems("kindle"))
+}
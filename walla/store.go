@@ -0,0 +1,120 @@
+package walla
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	// Registers the cgo-free "sqlite" database/sql driver.
+	_ "modernc.org/sqlite"
+)
+
+var (
+	ErrHistoryNotFound = errors.New("item history not found")
+)
+
+// PricePoint is the price of a listing since Time.
+type PricePoint struct {
+	Time     time.Time `json:"time"`
+	Title    string    `json:"title"`
+	Price    float32   `json:"price"`
+	Currency string    `json:"currency"`
+}
+
+// Store records the listings found in every feed update.
+type Store interface {
+	Record(ctx context.Context, objects []SearchObject, at time.Time) error
+	// History returns the price changes of a listing in chronological order,
+	// or ErrHistoryNotFound if it was never recorded.
+	History(ctx context.Context, itemID string) ([]PricePoint, error)
+}
+
+// SQLiteStore is a Store backed by an SQLite database with one row per
+// listing observation in the `observations` table.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS observations (
+	item_id     TEXT    NOT NULL,
+	title       TEXT    NOT NULL,
+	price       REAL    NOT NULL,
+	currency    TEXT    NOT NULL,
+	observed_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS observations_item_id ON observations (item_id, observed_at);
+`
+
+// OpenSQLiteStore opens the database in path, creating it if needed.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	// SQLite doesn't support concurrent writers.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sqlite schema: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Record(ctx context.Context, objects []SearchObject, at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO observations
+		(item_id, title, price, currency, observed_at) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, obj := range objects {
+		if _, err := stmt.ExecContext(ctx, obj.ID, obj.Title, obj.Price, obj.Currency,
+			at.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) History(ctx context.Context, itemID string) ([]PricePoint, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT observed_at, title, price, currency
+		FROM observations WHERE item_id = ? ORDER BY observed_at`, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []PricePoint
+	for rows.Next() {
+		var point PricePoint
+		var observedAt int64
+		if err := rows.Scan(&observedAt, &point.Title, &point.Price, &point.Currency); err != nil {
+			return nil, err
+		}
+		point.Time = time.Unix(observedAt, 0)
+		// Every update records the listing, only keep the changes.
+		if n := len(history); n != 0 && history[n-1].Price == point.Price &&
+			history[n-1].Currency == point.Currency {
+			continue
+		}
+		history = append(history, point)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, ErrHistoryNotFound
+	}
+	return history, nil
+}
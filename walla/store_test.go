@@ -0,0 +1,56 @@
+package walla
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStoreRecord(t *testing.T) {
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "walla.db"))
+	require.Nil(t, err)
+	defer store.Close()
+
+	at := time.Unix(1600000000, 0)
+	objects := []SearchObject{
+		{ID: "1", Title: "Kindle", Price: 50, Currency: "EUR"},
+		{ID: "2", Title: "Kindle Oasis", Price: 90.5, Currency: "EUR"},
+	}
+	require.Nil(t, store.Record(context.Background(), objects, at))
+	require.Nil(t, store.Record(context.Background(), objects[:1], at.Add(time.Hour)))
+
+	var count int
+	require.Nil(t, store.db.QueryRow(`SELECT COUNT(*) FROM observations WHERE item_id = '1'`).Scan(&count))
+	assert.Equal(t, 2, count)
+	var price float32
+	require.Nil(t, store.db.QueryRow(`SELECT price FROM observations WHERE item_id = '2'`).Scan(&price))
+	assert.Equal(t, float32(90.5), price)
+}
+
+func TestSQLiteStoreHistory(t *testing.T) {
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "walla.db"))
+	require.Nil(t, err)
+	defer store.Close()
+
+	at := time.Unix(1600000000, 0)
+	for i, price := range []float32{100, 100, 80, 80, 90} {
+		require.Nil(t, store.Record(context.Background(),
+			[]SearchObject{{ID: "1", Title: "Kindle", Price: price, Currency: "EUR"}},
+			at.Add(time.Duration(i)*time.Hour)))
+	}
+
+	history, err := store.History(context.Background(), "1")
+	require.Nil(t, err)
+	assert.Equal(t, []PricePoint{
+		{Time: at, Title: "Kindle", Price: 100, Currency: "EUR"},
+		{Time: at.Add(2 * time.Hour), Title: "Kindle", Price: 80, Currency: "EUR"},
+		{Time: at.Add(4 * time.Hour), Title: "Kindle", Price: 90, Currency: "EUR"},
+	}, history)
+
+	_, err = store.History(context.Background(), "2")
+	assert.Equal(t, ErrHistoryNotFound, err)
+}
@@ -0,0 +1,121 @@
+package walla
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	TelegramAPIURL = "https://api.telegram.org"
+
+	// DefaultTelegramBatchSize is the default maximum number of items sent in
+	// a single Telegram message.
+	DefaultTelegramBatchSize = 10
+	// DefaultTelegramInterval is the default minimum time between Telegram
+	// messages, to stay below the Bot API limits.
+	DefaultTelegramInterval = 3 * time.Second
+)
+
+// TelegramSender sends text messages to Telegram chats.
+type TelegramSender interface {
+	SendMessage(ctx context.Context, chatID, text string) error
+}
+
+// TelegramBot is a TelegramSender that uses the Telegram Bot API.
+type TelegramBot struct {
+	Token  string
+	URL    string
+	Client *http.Client
+}
+
+func NewTelegramBot(token string) *TelegramBot {
+	return &TelegramBot{
+		Token:  token,
+		URL:    TelegramAPIURL,
+		Client: &http.Client{Timeout: DefaultWebhookTimeout},
+	}
+}
+
+func (b *TelegramBot) SendMessage(ctx context.Context, chatID, text string) error {
+	form := url.Values{}
+	form.Set("chat_id", chatID)
+	form.Set("text", text)
+	form.Set("disable_web_page_preview", "true")
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%v/bot%v/sendMessage", b.URL, b.Token), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("building http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		// The error contains the URL, which contains the token.
+		return fmt.Errorf("doing telegram http request: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// TelegramNotifier sends the new items to the telegram_chat_id of their
+// query, batching up to BatchSize items per message and sending at most one
+// message every DefaultTelegramInterval.
+type TelegramNotifier struct {
+	Sender    TelegramSender
+	BatchSize int
+	limiter   *rate.Limiter
+}
+
+func NewTelegramNotifier(sender TelegramSender) *TelegramNotifier {
+	return &TelegramNotifier{
+		Sender:    sender,
+		BatchSize: DefaultTelegramBatchSize,
+		limiter:   rate.NewLimiter(rate.Every(DefaultTelegramInterval), 1),
+	}
+}
+
+func (n *TelegramNotifier) Notify(ctx context.Context, query *Query, items []NewItem) error {
+	if query.TelegramChatID == "" {
+		return nil
+	}
+	batchSize := n.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		if err := n.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := n.Sender.SendMessage(ctx, query.TelegramChatID,
+			telegramMessage(items[start:end])); err != nil {
+			return fmt.Errorf("sending telegram message: %w", err)
+		}
+	}
+	return nil
+}
+
+// telegramMessage formats items as a message with the title (which includes
+// the price) and the link of each item.
+func telegramMessage(items []NewItem) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "New in %v:\n", items[0].Feed)
+	for _, item := range items {
+		fmt.Fprintf(&b, "\n%v\n%v\n", item.Title, item.URL)
+	}
+	return b.String()
+}
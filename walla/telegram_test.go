@@ -0,0 +1,61 @@
+package walla
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type fakeTelegramSender struct {
+	chatIDs  []string
+	messages []string
+}
+
+func (s *fakeTelegramSender) SendMessage(ctx context.Context, chatID, text string) error {
+	s.chatIDs = append(s.chatIDs, chatID)
+	s.messages = append(s.messages, text)
+	return nil
+}
+
+func TestTelegramNotifierBatches(t *testing.T) {
+	sender := &fakeTelegramSender{}
+	notifier := NewTelegramNotifier(sender)
+	notifier.BatchSize = 2
+	notifier.limiter = rate.NewLimiter(rate.Inf, 1)
+
+	var items []NewItem
+	for i := 0; i < 3; i++ {
+		items = append(items, NewItem{Feed: "kindle", Title: fmt.Sprintf("Kindle %v - 50 EUR", i),
+			URL: fmt.Sprintf("https://es.wallapop.com/item/kindle-%v", i)})
+	}
+	require.Nil(t, notifier.Notify(context.Background(), &Query{}, items))
+	assert.Empty(t, sender.messages)
+
+	require.Nil(t, notifier.Notify(context.Background(), &Query{TelegramChatID: "-100"}, items))
+	assert.Equal(t, []string{"-100", "-100"}, sender.chatIDs)
+	assert.Equal(t, []string{
+		"New in kindle:\n\nKindle 0 - 50 EUR\nhttps://es.wallapop.com/item/kindle-0\n" +
+			"\nKindle 1 - 50 EUR\nhttps://es.wallapop.com/item/kindle-1\n",
+		"New in kindle:\n\nKindle 2 - 50 EUR\nhttps://es.wallapop.com/item/kindle-2\n",
+	}, sender.messages)
+}
+
+func TestTelegramBotSendMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/botTOKEN/sendMessage", r.URL.Path)
+		assert.Equal(t, "-100", r.FormValue("chat_id"))
+		assert.Equal(t, "hello", r.FormValue("text"))
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer srv.Close()
+
+	bot := NewTelegramBot("TOKEN")
+	bot.URL = srv.URL
+	require.Nil(t, bot.SendMessage(context.Background(), "-100", "hello"))
+}
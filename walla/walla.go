@@ -1,39 +1,571 @@
 package walla
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/http/cookiejar"
+	"net/mail"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/go-querystring/query"
 	"github.com/gorilla/feeds"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	USER_AGENT = "Mozilla/5.0 (X11; Linux x86_64; rv:67.0) Gecko/20100101 Firefox/67.0"
 	URL        = "https://es.wallapop.com"
 	URLAPIV3   = "https://api.wallapop.com/api/v3"
+
+	DefaultHTTPTimeout = 15 * time.Second
+	// DefaultRateLimit is the default maximum number of requests per second
+	// sent to the Wallapop API.
+	DefaultRateLimit = 2.0
+	// DefaultSearchRateLimit is the default maximum number of requests per
+	// second of the on-demand searches, within DefaultRateLimit.
+	DefaultSearchRateLimit = 1.0
+	// DefaultImageSize is the default resolution of the item images.
+	DefaultImageSize = 1024
+	// DefaultImageFrom is the default suffix of the big image URLs, their
+	// resolution.
+	DefaultImageFrom = "800"
+	// DefaultFeedAuthorName, DefaultFeedAuthorEmail and DefaultFeedLink are
+	// the default author and link of the feeds.
+	DefaultFeedAuthorName  = "Dhole"
+	DefaultFeedAuthorEmail = "dhole@riseup.net"
+	DefaultFeedLink        = "http://es.wallapop.com"
+	// DefaultLanguage is the default language of the searches.
+	DefaultLanguage = "es_ES"
+	// DefaultSearchAge is the default age of the oldest search results.
+	DefaultSearchAge = 15 * 24 * time.Hour
 )
 
+// maxResponseSize is the maximum size of the API responses.
+const maxResponseSize = 16 << 20
+
+// PricePresets are the price ranges that can be selected by name with the
+// price_preset of a query, as {MinPrice, MaxPrice}.
+var PricePresets = map[string][2]int{
+	"under_10":  {0, 10},
+	"under_50":  {0, 50},
+	"under_100": {0, 100},
+	"under_500": {0, 500},
+}
+
+// Languages are the languages supported by the searches.
+var Languages = []string{"es_ES", "ca_ES", "en_GB", "fr_FR", "it_IT", "pt_PT"}
+
+// ValidLanguage returns true if language is one of Languages.
+func ValidLanguage(language string) bool {
+	for _, l := range Languages {
+		if language == l {
+			return true
+		}
+	}
+	return false
+}
+
+// apiURL is the base URL of the Wallapop API, replaced in tests.
+var apiURL = URLAPIV3
+
+// httpClient is shared by all the requests to the Wallapop API so that
+// connections are reused.
+var httpClient = &http.Client{Timeout: DefaultHTTPTimeout, Transport: httpTransport, Jar: newCookieJar()}
+
+// newCookieJar returns a jar that keeps the cookies set by Wallapop during the
+// run.
+func newCookieJar() http.CookieJar {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return jar
+}
+
+// SetCookies enables or disables keeping the cookies set by Wallapop across
+// the requests.  Enabling them again starts with an empty jar.
+func SetCookies(enabled bool) {
+	if enabled {
+		httpClient.Jar = newCookieJar()
+	} else {
+		httpClient.Jar = nil
+	}
+}
+
+// httpTransport uses the proxy of the HTTP_PROXY and HTTPS_PROXY environment
+// variables unless set by SetProxy.
+var httpTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// SetHTTPTimeout sets the timeout of the requests to the Wallapop API.
+func SetHTTPTimeout(timeout time.Duration) {
+	httpClient.Timeout = timeout
+}
+
+// SetProxy sets the http, https or socks5 proxy URL of the requests to the
+// Wallapop API.  An empty URL uses the proxy of the environment.
+func SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		httpTransport.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("parsing proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	httpTransport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// limiter throttles all the requests to the Wallapop API.
+var limiter = rate.NewLimiter(DefaultRateLimit, 1)
+
+// SetRateLimit sets the maximum number of requests per second sent to the
+// Wallapop API.  A non-positive value disables the limit.
+func SetRateLimit(requestsPerSecond float64) {
+	if requestsPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(requestsPerSecond))
+}
+
+// searchLimiter also throttles the requests of the on-demand searches, so
+// that they leave part of the rate of limiter to the feed updates.
+var searchLimiter = rate.NewLimiter(DefaultSearchRateLimit, 1)
+
+// SetSearchRateLimit sets the maximum number of requests per second of the
+// on-demand searches, which also count towards SetRateLimit.  A non-positive
+// value only leaves them the limit of SetRateLimit.
+func SetSearchRateLimit(requestsPerSecond float64) {
+	if requestsPerSecond <= 0 {
+		searchLimiter.SetLimit(rate.Inf)
+		return
+	}
+	searchLimiter.SetLimit(rate.Limit(requestsPerSecond))
+}
+
+// onDemandKey is the context key that marks the requests of the on-demand
+// searches.
+type onDemandKey struct{}
+
+// onDemand returns ctx for the requests of an on-demand search.
+func onDemand(ctx context.Context) context.Context {
+	return context.WithValue(ctx, onDemandKey{}, true)
+}
+
+// waitLimiters waits until a request can be sent with ctx according to the
+// rate limits.
+func waitLimiters(ctx context.Context) error {
+	if ctx.Value(onDemandKey{}) != nil {
+		if err := searchLimiter.Wait(ctx); err != nil {
+			return fmt.Errorf("waiting for search rate limiter: %w", err)
+		}
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for rate limiter: %w", err)
+	}
+	return nil
+}
+
+// Location is a place searched around.
+type Location struct {
+	Name string `toml:"name" yaml:"name" json:"name"`
+	// Latitude and Longitude are used instead of Name when set.
+	Latitude  float32 `toml:"latitude" yaml:"latitude" json:"latitude"`
+	Longitude float32 `toml:"longitude" yaml:"longitude" json:"longitude"`
+	// Radius is the search radius in the RadiusUnit of the query.
+	Radius int `toml:"radius" yaml:"radius" json:"radius"`
+}
+
+// hasCoordinates returns true if the location is given by coordinates.
+func (l *Location) hasCoordinates() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
 type Query struct {
-	Keywords       []string `toml:"keywords"`
-	Ignores        []string `toml:"ignores"`
-	LocationName   string   `toml:"location_name"`
-	LocationRadius int      `toml:"location_radius"`
-	MinPrice       int      `toml:"min_price"`
-	MaxPrice       int      `toml:"max_price"`
+	// Enabled can be set to false to stop updating and serving the feed
+	// without removing the query.
+	Enabled      *bool    `toml:"enabled" yaml:"enabled" json:"enabled"`
+	Keywords     []string `toml:"keywords" yaml:"keywords" json:"keywords"`
+	Ignores      []string `toml:"ignores" yaml:"ignores" json:"ignores"`
+	LocationName string   `toml:"location_name" yaml:"location_name" json:"location_name"`
+	// Latitude and Longitude are used instead of LocationName when set.
+	Latitude       float32 `toml:"latitude" yaml:"latitude" json:"latitude"`
+	Longitude      float32 `toml:"longitude" yaml:"longitude" json:"longitude"`
+	LocationRadius int     `toml:"location_radius" yaml:"location_radius" json:"location_radius"`
+	// RadiusUnit is the unit of the location radius, "km" (the default) or
+	// "m".
+	RadiusUnit string `toml:"radius_unit" yaml:"radius_unit" json:"radius_unit"`
+	// Locations are searched instead of the single location given by
+	// LocationName, Latitude, Longitude and LocationRadius when set.
+	Locations []Location `toml:"locations" yaml:"locations" json:"locations"`
+	MinPrice  int        `toml:"min_price" yaml:"min_price" json:"min_price"`
+	// MaxPrice is the maximum price, unlimited if unset.
+	MaxPrice int `toml:"max_price" yaml:"max_price" json:"max_price"`
+	// MinSellerRating drops the listings of the sellers whose reviews are
+	// rated below this, in stars from 0 to 5.  The sellers without reviews
+	// are kept.  When the search results don't report the rating, it's
+	// fetched once per seller and cached, an extra request to Wallapop.
+	MinSellerRating float32 `toml:"min_seller_rating" yaml:"min_seller_rating" json:"min_seller_rating"`
+	// IgnoreSellers drops the listings of these sellers, given by user ID or
+	// micro name.
+	IgnoreSellers []string `toml:"ignore_sellers" yaml:"ignore_sellers" json:"ignore_sellers"`
+	// OnlySellers drops the listings of any other seller when set.
+	OnlySellers []string `toml:"only_sellers" yaml:"only_sellers" json:"only_sellers"`
+	// MarkStatus prefixes the title of the sold and reserved listings with
+	// [SOLD] or [RESERVED].  Sold takes precedence when both are set.
+	MarkStatus bool `toml:"mark_status" yaml:"mark_status" json:"mark_status"`
+	// Currency drops the listings priced in other currencies, e.g. "EUR",
+	// when set.
+	Currency string `toml:"currency" yaml:"currency" json:"currency"`
+	// FreeOnly keeps only the listings given away for free, by capping the
+	// price range at 0 on load.
+	FreeOnly bool `toml:"free_only" yaml:"free_only" json:"free_only"`
+	// ShippingOnly keeps only the listings that can be shipped.  It's
+	// requested to the search and, as it's not always honored, the listings
+	// whose search result says they can't be shipped are dropped.  Listings
+	// without shipping information are kept.
+	ShippingOnly bool `toml:"shipping_only" yaml:"shipping_only" json:"shipping_only"`
+	// CategoryIDs restricts the search to these Wallapop categories, and
+	// drops the listings of other categories since the search doesn't always
+	// honor them.  Any category if unset.
+	CategoryIDs []int `toml:"category_ids" yaml:"category_ids" json:"category_ids"`
+	// PricePreset is the name of one of PricePresets, which sets MinPrice
+	// and MaxPrice on load.
+	PricePreset string `toml:"price_preset" yaml:"price_preset" json:"price_preset"`
+	// MaxDistanceKm drops the listings farther than this from the location,
+	// regardless of the distance used by the search.  Unlimited if unset.
+	MaxDistanceKm float32 `toml:"max_distance_km" yaml:"max_distance_km" json:"max_distance_km"`
+	// ImageSize is the resolution of the item images, DefaultImageSize if
+	// unset.
+	ImageSize int `toml:"image_size" yaml:"image_size" json:"image_size"`
+	// ImageFrom is the suffix of the big image URLs that is replaced by
+	// ImageTo, DefaultImageFrom if unset.
+	ImageFrom string `toml:"image_from" yaml:"image_from" json:"image_from"`
+	// ImageTo replaces ImageFrom at the end of the big image URLs, ImageSize
+	// if unset.
+	ImageTo string `toml:"image_to" yaml:"image_to" json:"image_to"`
+	// MaxImages caps the number of images of each item, unlimited if unset.
+	MaxImages int `toml:"max_images" yaml:"max_images" json:"max_images"`
+	// MaxDescriptionChars truncates the text of the item descriptions to this
+	// many characters, unlimited if unset.
+	MaxDescriptionChars int `toml:"max_description_chars" yaml:"max_description_chars" json:"max_description_chars"`
+	// MediaThumbnails adds the first image of every item as a Media RSS
+	// thumbnail, for the readers that show previews.
+	MediaThumbnails bool `toml:"media_thumbnails" yaml:"media_thumbnails" json:"media_thumbnails"`
+	// IncludeImages can be set to false for text-only items, without images
+	// nor thumbnails.  FeedsConfig.NoImages if unset.
+	IncludeImages *bool `toml:"include_images" yaml:"include_images" json:"include_images"`
+	// Language is the language of the search, DefaultLanguage if unset.
+	Language string `toml:"language" yaml:"language" json:"language"`
+	// UpdateIntervalMinutes is the interval between the updates of the feed,
+	// FeedsConfig.UpdateInterval if unset.
+	UpdateIntervalMinutes int `toml:"update_interval_minutes" yaml:"update_interval_minutes" json:"update_interval_minutes"`
+	// FirstPageOnly only fetches the first page of the searches, the newest
+	// listings, for queries polled very often with a short
+	// update_interval_minutes.  The listings pushed out of the first page
+	// between two updates are missed.
+	FirstPageOnly bool `toml:"first_page_only" yaml:"first_page_only" json:"first_page_only"`
+	// MaxAgeDays is the age in days of the oldest items of the feed,
+	// DefaultSearchAge if unset.
+	MaxAgeDays int `toml:"max_age_days" yaml:"max_age_days" json:"max_age_days"`
+	// WebhookURL receives a POST with every new item of the feed.
+	WebhookURL string `toml:"webhook_url" yaml:"webhook_url" json:"webhook_url"`
+	// TelegramChatID receives a Telegram message with the new items of the
+	// feed.
+	TelegramChatID string `toml:"telegram_chat_id" yaml:"telegram_chat_id" json:"telegram_chat_id"`
+	// EmailTo is a comma-separated list of addresses that receive an email
+	// with the new items of the feed.
+	EmailTo string `toml:"email_to" yaml:"email_to" json:"email_to"`
+	// NotifyOnFirstRun reports all the items of the first update of the feed
+	// as new.
+	NotifyOnFirstRun bool `toml:"notify_on_first_run" yaml:"notify_on_first_run" json:"notify_on_first_run"`
+	// name is the name of the query, set for its feed updates.
+	name string
+	// maxPriceZero caps the price range at 0, set on load by FreeOnly, as a
+	// zero MaxPrice is unlimited.
+	maxPriceZero bool
+}
+
+// clone returns a copy of the query that doesn't share its slices.
+func (q Query) clone() Query {
+	if q.Enabled != nil {
+		enabled := *q.Enabled
+		q.Enabled = &enabled
+	}
+	if q.IncludeImages != nil {
+		includeImages := *q.IncludeImages
+		q.IncludeImages = &includeImages
+	}
+	q.Keywords = cloneStrings(q.Keywords)
+	q.Ignores = cloneStrings(q.Ignores)
+	q.IgnoreSellers = cloneStrings(q.IgnoreSellers)
+	q.OnlySellers = cloneStrings(q.OnlySellers)
+	if q.CategoryIDs != nil {
+		q.CategoryIDs = append([]int(nil), q.CategoryIDs...)
+	}
+	if q.Locations != nil {
+		q.Locations = append([]Location(nil), q.Locations...)
+	}
+	return q
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+// enabled returns whether the query feed is updated and served.
+func (q *Query) enabled() bool {
+	return q.Enabled == nil || *q.Enabled
+}
+
+// categoryIDs returns the CategoryIDs of the search of the query.
+func (q *Query) categoryIDs() string {
+	ids := make([]string, len(q.CategoryIDs))
+	for i, id := range q.CategoryIDs {
+		ids[i] = strconv.Itoa(id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// inCategories returns whether a listing of the category id, zero if unknown,
+// belongs in the feed of the query.
+func (q *Query) inCategories(id int) bool {
+	if id == 0 || len(q.CategoryIDs) == 0 {
+		return true
+	}
+	for _, categoryID := range q.CategoryIDs {
+		if categoryID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// searchAge returns the age of the oldest items of the query feed.
+func (q *Query) searchAge() time.Duration {
+	if q.MaxAgeDays == 0 {
+		return DefaultSearchAge
+	}
+	return time.Duration(q.MaxAgeDays) * 24 * time.Hour
+}
+
+// validCurrency returns true if currency looks like an ISO 4217 code.
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// searchOpts returns the options of the searches of the query.
+func (q *Query) searchOpts() SearchOpts {
+	return SearchOpts{Age: q.searchAge(), FirstPageOnly: q.FirstPageOnly}
+}
+
+// language returns the language of the query search.
+func (q *Query) language() string {
+	if q.Language == "" {
+		return DefaultLanguage
+	}
+	return q.Language
+}
+
+// KmToMeters returns the search distance in meters of a radius in km.
+func KmToMeters(km int) float32 {
+	return float32(km * 1000)
+}
+
+// searchDistance returns the search distance in meters of a location radius.
+func (q *Query) searchDistance(radius int) float32 {
+	if q.RadiusUnit == "m" {
+		return float32(radius)
+	}
+	return KmToMeters(radius)
+}
+
+// locations returns the locations searched by the query.
+func (q *Query) locations() []Location {
+	if len(q.Locations) != 0 {
+		return q.Locations
+	}
+	return []Location{{
+		Name:      q.LocationName,
+		Latitude:  q.Latitude,
+		Longitude: q.Longitude,
+		Radius:    q.LocationRadius,
+	}}
+}
+
+// Validate returns an error listing all the problems of the query.
+func (q *Query) Validate() error {
+	var problems []string
+	if len(q.Keywords) == 0 {
+		problems = append(problems, "no keywords")
+	}
+	for _, keyword := range q.Keywords {
+		if strings.TrimSpace(keyword) == "" {
+			problems = append(problems, "empty keyword")
+			break
+		}
+	}
+	if len(q.Locations) == 0 {
+		location := q.locations()[0]
+		if location.Name == "" && !location.hasCoordinates() {
+			problems = append(problems, "no location_name nor coordinates")
+		}
+		if location.Radius <= 0 {
+			problems = append(problems, "location_radius must be positive")
+		}
+	}
+	for i, location := range q.Locations {
+		if location.Name == "" && !location.hasCoordinates() {
+			problems = append(problems, fmt.Sprintf("location %v has no name nor coordinates", i+1))
+		}
+		if location.Radius <= 0 {
+			problems = append(problems, fmt.Sprintf("location %v radius must be positive", i+1))
+		}
+	}
+	for _, id := range q.CategoryIDs {
+		if id <= 0 {
+			problems = append(problems, "category_ids must be positive")
+			break
+		}
+	}
+	if q.MinSellerRating < 0 || q.MinSellerRating > 5 {
+		problems = append(problems, "min_seller_rating must be between 0 and 5")
+	}
+	if q.MaxDistanceKm < 0 {
+		problems = append(problems, "negative max_distance_km")
+	}
+	if q.MinPrice < 0 {
+		problems = append(problems, "negative min_price")
+	}
+	if q.MaxPrice < 0 {
+		problems = append(problems, "negative max_price")
+	}
+	if q.ImageSize < 0 {
+		problems = append(problems, "negative image_size")
+	}
+	if q.ImageSize != 0 && q.ImageTo != "" {
+		problems = append(problems, "image_size can't be combined with image_to")
+	}
+	if q.MaxImages < 0 {
+		problems = append(problems, "negative max_images")
+	}
+	if q.MaxDescriptionChars < 0 {
+		problems = append(problems, "negative max_description_chars")
+	}
+	if q.MaxAgeDays < 0 {
+		problems = append(problems, "negative max_age_days")
+	}
+	if q.UpdateIntervalMinutes < 0 {
+		problems = append(problems, "negative update_interval_minutes")
+	}
+	if q.RadiusUnit != "" && q.RadiusUnit != "km" && q.RadiusUnit != "m" {
+		problems = append(problems, fmt.Sprintf("unknown radius_unit %q", q.RadiusUnit))
+	}
+	if q.Currency != "" && !validCurrency(q.Currency) {
+		problems = append(problems, fmt.Sprintf("currency %q is not a 3 letter code", q.Currency))
+	}
+	if q.Language != "" && !ValidLanguage(q.Language) {
+		problems = append(problems, fmt.Sprintf("unknown language %q", q.Language))
+	}
+	if q.WebhookURL != "" {
+		if u, err := url.Parse(q.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, "webhook_url is not an http(s) URL")
+		}
+	}
+	if q.EmailTo != "" {
+		if _, err := mail.ParseAddressList(q.EmailTo); err != nil {
+			problems = append(problems, "email_to is not a list of email addresses")
+		}
+	}
+	if q.PricePreset != "" {
+		if _, ok := PricePresets[q.PricePreset]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown price_preset %q", q.PricePreset))
+		}
+		if q.MinPrice != 0 || q.MaxPrice != 0 {
+			problems = append(problems, "price_preset can't be combined with min_price or max_price")
+		}
+	}
+	if q.FreeOnly && (q.MinPrice != 0 || q.MaxPrice != 0 || q.PricePreset != "") {
+		problems = append(problems, "free_only can't be combined with a price range")
+	}
+	if q.MaxPrice != 0 && q.MinPrice > q.MaxPrice {
+		problems = append(problems, fmt.Sprintf("min_price (%v) is greater than max_price (%v)",
+			q.MinPrice, q.MaxPrice))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, ", "))
+}
+
+// ValidationError lists the problems found in the queries of a queries file.
+type ValidationError struct {
+	// Problems has one entry per invalid query, sorted by query name.
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid queries: %v", strings.Join(e.Problems, "; "))
+}
+
+// validateQueries returns a *ValidationError if any of the queries is
+// invalid.
+func validateQueries(queries map[string]Query) error {
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		query := queries[name]
+		if err := query.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("query %q: %v", name, err))
+		}
+	}
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
 }
 
 type Queries struct {
@@ -45,7 +577,11 @@ type Queries struct {
 func (q *Queries) Get() map[string]Query {
 	q.m.RLock()
 	defer q.m.RUnlock()
-	return q.queries
+	queries := make(map[string]Query, len(q.queries))
+	for name, query := range q.queries {
+		queries[name] = query.clone()
+	}
+	return queries
 }
 
 func (q *Queries) set(queries map[string]Query) {
@@ -54,15 +590,47 @@ func (q *Queries) set(queries map[string]Query) {
 	q.queries = queries
 }
 
+// decodeQueriesFile decodes the queries file in path according to its
+// extension: `.yaml`/`.yml` for YAML, `.json` for JSON and TOML otherwise.
+func decodeQueriesFile(path string, queries *map[string]Query) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(data, queries)
+	case ".json":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, queries)
+	default:
+		_, err := toml.DecodeFile(path, queries)
+		return err
+	}
+}
+
 func (q *Queries) Load() error {
 	queries := make(map[string]Query)
-	if _, err := toml.DecodeFile(q.path, &queries); err != nil {
+	if err := decodeQueriesFile(q.path, &queries); err != nil {
+		return err
+	}
+	if err := validateQueries(queries); err != nil {
 		return err
 	}
-	for name, _ := range queries {
-		for i, ignore := range queries[name].Ignores {
-			queries[name].Ignores[i] = strings.ToLower(ignore)
+	for name, query := range queries {
+		for i, ignore := range query.Ignores {
+			query.Ignores[i] = strings.ToLower(ignore)
+		}
+		if preset, ok := PricePresets[query.PricePreset]; ok {
+			query.MinPrice, query.MaxPrice = preset[0], preset[1]
+		}
+		if query.FreeOnly {
+			query.MinPrice, query.MaxPrice, query.maxPriceZero = 0, 0, true
 		}
+		queries[name] = query
 	}
 	q.set(queries)
 	return nil
@@ -82,95 +650,322 @@ type CacheEntry struct {
 }
 
 type Cache struct {
+	// The counters are updated atomically, first in the struct to be 64-bit
+	// aligned.
+	hits       uint64
+	misses     uint64
+	evictions  uint64
 	expiration time.Duration
 	entries    map[string]CacheEntry
-	fetchFn    func(key string) (interface{}, error)
-	m          sync.RWMutex
+	fetchFn    func(ctx context.Context, key string) (interface{}, error)
+	// now returns the current time, replaced in the tests.
+	now func() time.Time
+	m   sync.RWMutex
 }
 
-func NewCache(fetchFn func(key string) (interface{}, error), expiration time.Duration) *Cache {
+func NewCache(fetchFn func(ctx context.Context, key string) (interface{}, error),
+	expiration time.Duration) *Cache {
 	return &Cache{
 		expiration: expiration,
 		entries:    make(map[string]CacheEntry),
 		fetchFn:    fetchFn,
+		now:        time.Now,
 	}
 }
 
-func (c *Cache) Get(key string) (interface{}, error) {
-	c.Clean()
+func (c *Cache) Get(ctx context.Context, key string) (interface{}, error) {
+	if value, ok := c.Lookup(key); ok {
+		return value, nil
+	}
+	value, err := c.fetchFn(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(key, value)
+	return value, nil
+}
+
+// Lookup returns the value of key if it's cached and hasn't expired, without
+// fetching it.
+func (c *Cache) Lookup(key string) (interface{}, bool) {
 	c.m.RLock()
 	entry, ok := c.entries[key]
 	c.m.RUnlock()
-	if ok {
+	if ok && c.fresh(entry, c.now()) {
+		atomic.AddUint64(&c.hits, 1)
 		log.WithField("key", key).Debug("Cache hit")
-		return entry.Value, nil
+		return entry.Value, true
 	}
+	atomic.AddUint64(&c.misses, 1)
 	log.WithField("key", key).Debug("Cache miss")
-	value, err := c.fetchFn(key)
-	if err != nil {
-		return nil, err
-	}
+	return nil, false
+}
+
+// Put caches value as the value of key fetched now.
+func (c *Cache) Put(key string, value interface{}) {
 	c.m.Lock()
 	c.entries[key] = CacheEntry{
-		Timestamp: time.Now(),
+		Timestamp: c.now(),
 		Value:     value,
 	}
 	c.m.Unlock()
-	return value, nil
 }
 
+// fresh returns whether entry hasn't expired at now.
+func (c *Cache) fresh(entry CacheEntry, now time.Time) bool {
+	return !entry.Timestamp.Before(now.Add(-c.expiration))
+}
+
+// Clean removes the expired entries.
 func (c *Cache) Clean() {
 	c.m.Lock()
 	defer c.m.Unlock()
-	maxTimestamp := time.Now().Add(-c.expiration)
+	now := c.now()
 	for key, entry := range c.entries {
-		if entry.Timestamp.Before(maxTimestamp) {
+		if !c.fresh(entry, now) {
 			delete(c.entries, key)
+			atomic.AddUint64(&c.evictions, 1)
+		}
+	}
+}
+
+// Run cleans the cache every interval until ctx is done.
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Clean()
 		}
 	}
 }
 
+// CacheStats are the counters of a Cache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Size      int    `json:"size"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// Stats returns the number of lookups found and not found in the cache, its
+// current number of entries and the number of entries expired.
+func (c *Cache) Stats() CacheStats {
+	c.m.RLock()
+	size := len(c.entries)
+	c.m.RUnlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Size:      size,
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
 var KEY = []byte("Tm93IHRoYXQgeW91J3ZlIGZvdW5kIHRoaXMsIGFyZSB5b3UgcmVhZHkgdG8gam9pbiB1cz8gam9ic0B3YWxsYXBvcC5jb20==")
 
-func sign(url, method, timestamp string) string {
-	req := strings.TrimPrefix(url, "https://api.wallapop.com")
-	msg := fmt.Sprintf("%s|%s|%s|", strings.ToUpper(method), req, timestamp)
-	h := hmac.New(sha256.New, KEY)
+// DefaultSignFormat is the message signed to authenticate the requests, with
+// {method}, {path} and {timestamp} replaced by the ones of the request.
+const DefaultSignFormat = "{method}|{path}|{timestamp}|"
+
+// signFormat and signKey are the message format and the HMAC key of the
+// request signatures, set by SetSigning.  signQuery, set by SetSignQuery,
+// adds the query string to the signed path.
+var (
+	signFormat = DefaultSignFormat
+	signKey    = KEY
+	signQuery  = false
+)
+
+// SetSigning overrides the message format and the HMAC key of the request
+// signatures, in case Wallapop changes its signing scheme.  Empty values
+// keep DefaultSignFormat and KEY.
+func SetSigning(format, key string) error {
+	if format == "" {
+		format = DefaultSignFormat
+	}
+	if !strings.Contains(format, "{timestamp}") {
+		return fmt.Errorf("signing format %q has no {timestamp}", format)
+	}
+	signFormat = format
+	signKey = KEY
+	if key != "" {
+		signKey = []byte(key)
+	}
+	return nil
+}
+
+// SetSignQuery sets whether the signed {path} of the requests includes their
+// query string, canonicalized by sorting the parameters.  By default only the
+// path is signed, as the Wallapop API expects.
+func SetSignQuery(enabled bool) {
+	signQuery = enabled
+}
+
+// CustomSigning returns whether the signing scheme was overridden by
+// SetSigning or SetSignQuery.
+func CustomSigning() bool {
+	return signFormat != DefaultSignFormat || !hmac.Equal(signKey, KEY) || signQuery
+}
+
+// canonicalQuery returns the query string params with the parameters sorted
+// by key, so that the signature doesn't depend on their order.  params is
+// returned unchanged if it can't be parsed.
+func canonicalQuery(params string) string {
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		return params
+	}
+	return values.Encode()
+}
+
+// signMessage returns the signature of the request of url with method at
+// timestamp with the message format and key.
+func signMessage(format string, key []byte, url, method, timestamp string) string {
+	msg := strings.NewReplacer(
+		"{method}", strings.ToUpper(method),
+		"{path}", strings.TrimPrefix(url, "https://api.wallapop.com"),
+		"{timestamp}", timestamp,
+	).Replace(format)
+	h := hmac.New(sha256.New, key)
 	h.Write([]byte(msg))
 	signature := h.Sum(nil)
 	return base64.StdEncoding.EncodeToString(signature)
 }
 
-func signNow(url, method string) (string, string) {
+func sign(url, method, timestamp string) string {
+	return signMessage(signFormat, signKey, url, method, timestamp)
+}
+
+// CheckSigning returns an error if the signature of a reference request with
+// the default signing scheme isn't the one known to be accepted by the API.
+func CheckSigning() error {
+	const expected = "6iU/x0HyEqX2dzMTdv1QsTtBX4Z8tZTuHJmhzMXnxuU="
+	sig := signMessage(DefaultSignFormat, KEY, "/api/v3/suggesters/search", "get", "1565827270558")
+	if sig != expected {
+		return fmt.Errorf("signature of the reference request is %v instead of %v", sig, expected)
+	}
+	return nil
+}
+
+// signNow returns the signature and the timestamp of the request of url with
+// the query string params, which is only signed if enabled by SetSignQuery.
+func signNow(url, params, method string) (string, string) {
 	timestamp := fmt.Sprintf("%v", time.Now().Unix())
-	return sign(url, method, timestamp), timestamp
+	return signAt(url, params, method, timestamp), timestamp
+}
+
+func signAt(url, params, method, timestamp string) string {
+	if signQuery && params != "" {
+		url = url + "?" + canonicalQuery(params)
+	}
+	return sign(url, method, timestamp)
+}
+
+// HTTPError is returned when the Wallapop API replies with a non-2xx status
+// code.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("http status code is %v", e.StatusCode)
+}
+
+// ErrBotChallenge is returned when Wallapop replies with an anti-bot challenge
+// page, e.g. from Cloudflare, instead of the API response.
+var ErrBotChallenge = errors.New("blocked by an anti-bot challenge")
+
+// botChallengeTitles are the page titles of the known anti-bot challenges.
+var botChallengeTitles = []string{"attention required", "just a moment", "captcha"}
+
+// isBotChallenge returns whether the response is an anti-bot challenge page: a
+// 403 with an HTML body or an HTML page with a known challenge title.
+func isBotChallenge(resp *http.Response, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" {
+		return false
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return true
+	}
+	page := strings.ToLower(string(body))
+	start := strings.Index(page, "<title>")
+	end := strings.Index(page, "</title>")
+	if start == -1 || end < start {
+		return false
+	}
+	title := page[start+len("<title>") : end]
+	for _, challenge := range botChallengeTitles {
+		if strings.Contains(title, challenge) {
+			return true
+		}
+	}
+	return false
 }
 
-func GetParamsString(url string, params string, res interface{}) (*http.Response, error) {
-	signature, timestamp := signNow(url, "get")
+// GetParamsString sends a signed GET request with the encoded params to url
+// and unmarshals its JSON response into res, unless the circuit breaker is
+// open.  The rate limiters are waited for before the breaker, so that their
+// errors aren't counted as failed requests.
+func GetParamsString(ctx context.Context, url string, params string, res interface{}) (*http.Response, error) {
+	if err := waitLimiters(ctx); err != nil {
+		return nil, err
+	}
+	probe, err := breaker.allow(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getParamsString(ctx, url, params, res)
+	breaker.done(ctx, probe, err, time.Now())
+	return resp, err
+}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", url, params), nil)
+// newRequest returns the signed GET request of url with the encoded params.
+func newRequest(ctx context.Context, url string, params string) (*http.Request, error) {
+	signature, timestamp := signNow(url, params, "get")
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s?%s", url, params), nil)
 	if err != nil {
 		return nil, fmt.Errorf("building http request: %w", err)
 	}
 	req.Header.Set("User-Agent", USER_AGENT)
 	req.Header.Set("Timestamp", timestamp)
 	req.Header.Set("X-Signature", signature)
-	resp, err := http.DefaultClient.Do(req)
+	return req, nil
+}
+
+func getParamsString(ctx context.Context, url string, params string, res interface{}) (*http.Response, error) {
+	req, err := newRequest(ctx, url, params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		log.WithField("url", url).Error("Failed http request")
 		return nil, fmt.Errorf("doing http request: %w", err)
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
 	if err != nil {
 		return nil, fmt.Errorf("reading http response body: %w", err)
 	}
+	if len(body) > maxResponseSize {
+		return nil, fmt.Errorf("http response body larger than %v bytes", maxResponseSize)
+	}
 	log.WithField("url", url).Debug("HTTP GET")
+	if isBotChallenge(resp, body) {
+		log.WithField("url", url).WithField("status", resp.StatusCode).
+			Warn("Blocked by an anti-bot challenge")
+		return nil, fmt.Errorf("%w (http status code is %v)", ErrBotChallenge, resp.StatusCode)
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		log.WithField("url", url).WithField("body", string(body)).WithField("params", params).
 			Error("Bad http request")
-		return nil, fmt.Errorf("http status code is %v", resp.StatusCode)
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	// fmt.Printf("DBG Req: %+v\n", req)
 	// log.Debug(resp.Request.URL)
@@ -179,47 +974,134 @@ func GetParamsString(url string, params string, res interface{}) (*http.Response
 	// fmt.Println("\n###")
 	if err := json.Unmarshal(body, res); err != nil {
 		log.WithField("url", url).WithField("body", string(body)).Error("Bad json body")
+		contentType := resp.Header.Get("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); !isJSONMediaType(mediaType) {
+			return nil, fmt.Errorf("expected JSON, got %v: %q", contentType, snippet(body))
+		}
 		return nil, fmt.Errorf("json unmarshaling http response body: %w", err)
 	}
 	return resp, nil
 }
 
-func Get(url string, params interface{}, res interface{}) (*http.Response, error) {
-	v, err := query.Values(params)
-	if err != nil {
-		return nil, fmt.Errorf("parsing url params: %w", err)
-	}
-	return GetParamsString(url, v.Encode(), res)
+// isJSONMediaType returns whether mediaType is JSON, e.g. application/json or
+// application/problem+json.
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
 }
 
-type ReqMapsHerePlace struct {
-	PlaceID string `url:"placeId"`
+// snippet returns the beginning of body to show in errors.
+func snippet(body []byte) string {
+	const size = 200
+	if len(body) > size {
+		return string(body[:size]) + "..."
+	}
+	return string(body)
 }
 
-type ResMapsHerePlace struct {
-	Latitude  float32 `json:"latitude"`
-	Longitude float32 `json:"longitude"`
+// RawResponse is an API response as received, together with its request.
+type RawResponse struct {
+	URL            string            `json:"url"`
+	RequestHeaders map[string]string `json:"request_headers"`
+	StatusCode     int               `json:"status_code"`
+	Headers        map[string]string `json:"headers"`
+	// Body is set when the response is JSON, and BodyText otherwise.
+	Body     json.RawMessage `json:"body,omitempty"`
+	BodyText string          `json:"body_text,omitempty"`
 }
 
-type ReqSearch struct {
-	Distance      float32 `url:"distance"`
-	Keywords      string  `url:"keywords"`
-	FiltersSource string  `url:"filters_source"`
-	OrderBy       string  `url:"order_by"`
-	MinSalePrice  int     `url:"min_sale_price"`
-	MaxSalePrice  int     `url:"max_sale_price"`
-	Latitude      float32 `url:"latitude"`
-	Longitude     float32 `url:"longitude"`
-	Language      string  `url:"language"`
-	// Step           int     `url:"step"`
-	// SearchID       string  `url:"search_id"`
-	// PaginationDate string  `url:"pagination_date"`
+// headerMap returns the headers h with their values joined, without the
+// cookies.
+func headerMap(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for name, values := range h {
+		if name == "Cookie" || name == "Set-Cookie" {
+			continue
+		}
+		m[name] = strings.Join(values, ", ")
+	}
+	return m
+}
+
+// GetRaw sends the same request as GetParamsString and returns the response
+// as received, whatever its status, for debugging.  It ignores the circuit
+// breaker.
+func GetRaw(ctx context.Context, url string, params string) (*RawResponse, error) {
+	if err := waitLimiters(ctx); err != nil {
+		return nil, err
+	}
+	req, err := newRequest(ctx, url, params)
+	if err != nil {
+		return nil, err
+	}
+	raw := &RawResponse{URL: req.URL.String(), RequestHeaders: headerMap(req.Header)}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doing http request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading http response body: %w", err)
+	}
+	if len(body) > maxResponseSize {
+		return nil, fmt.Errorf("http response body larger than %v bytes", maxResponseSize)
+	}
+	raw.StatusCode = resp.StatusCode
+	raw.Headers = headerMap(resp.Header)
+	if json.Valid(body) {
+		raw.Body = body
+	} else {
+		raw.BodyText = string(body)
+	}
+	return raw, nil
+}
+
+func Get(ctx context.Context, url string, params interface{}, res interface{}) (*http.Response, error) {
+	v, err := query.Values(params)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url params: %w", err)
+	}
+	return GetParamsString(ctx, url, v.Encode(), res)
+}
+
+type ReqMapsHerePlace struct {
+	PlaceID string `url:"placeId"`
+}
+
+type ResMapsHerePlace struct {
+	Latitude  float32 `json:"latitude"`
+	Longitude float32 `json:"longitude"`
+}
+
+type ReqSearch struct {
+	Distance      float32 `url:"distance"`
+	Keywords      string  `url:"keywords"`
+	FiltersSource string  `url:"filters_source"`
+	OrderBy       string  `url:"order_by"`
+	MinSalePrice  int     `url:"min_sale_price,omitempty"`
+	MaxSalePrice  *int    `url:"max_sale_price,omitempty"`
+	IsShippable   bool    `url:"is_shippable,omitempty"`
+	Latitude      float32 `url:"latitude"`
+	Longitude     float32 `url:"longitude"`
+	Language      string  `url:"language"`
+	// CategoryIDs is a comma-separated list of category IDs.
+	CategoryIDs string `url:"category_ids,omitempty"`
+	// Step, SearchID and PaginationDate select the next page of a search,
+	// as given by its NextPage.
+	Step           int    `url:"step,omitempty"`
+	SearchID       string `url:"search_id,omitempty"`
+	PaginationDate string `url:"pagination_date,omitempty"`
 }
 
 type User struct {
 	ID        string `json:"id"`
 	MicroName string `json:"micro_name"`
 	Image     Image  `json:"images"`
+	// Rating is the average rating of the reviews of the user in stars, from
+	// 0 to 5, nil when the search result doesn't report it.
+	Rating *float32 `json:"rating"`
+	// Reviews is the number of reviews of the user.
+	Reviews int `json:"reviews"`
 }
 
 type Image struct {
@@ -235,6 +1117,12 @@ type Flags struct {
 	OnHold   bool `json:"onhold"`
 }
 
+// Shipping is the shipping availability of a listing.
+type Shipping struct {
+	ItemIsShippable    bool `json:"item_is_shippable"`
+	UserAllowsShipping bool `json:"user_allows_shipping"`
+}
+
 type SearchObject struct {
 	ID          string  `json:"id"`
 	Title       string  `json:"title"`
@@ -246,6 +1134,15 @@ type SearchObject struct {
 	Price       float32 `json:"price"`
 	Currency    string  `json:"currency"`
 	WebSlug     string  `json:"web_slug"`
+	// Shipping is nil when the search result doesn't report it.
+	Shipping *Shipping `json:"shipping"`
+	// CategoryID is zero when the search result doesn't report it.
+	CategoryID int `json:"category_id"`
+}
+
+// Shippable returns whether the listing can be shipped, true when unknown.
+func (o *SearchObject) Shippable() bool {
+	return o.Shipping == nil || (o.Shipping.ItemIsShippable && o.Shipping.UserAllowsShipping)
 }
 
 type NextPage struct {
@@ -278,7 +1175,9 @@ func NewNextPage(raw string) (*NextPage, error) {
 
 type ResSearch struct {
 	SearchObjects []SearchObject `json:"search_objects"`
-	// NextPage      NextPage
+	// PaginationDate is the pagination date of the second page of the
+	// search, to be used as SearchOpts.Since by a later search.
+	PaginationDate time.Time `json:"-"`
 }
 
 type ItemImage struct {
@@ -293,66 +1192,136 @@ type ResItem struct {
 	Images       []ItemImage `json:"images"`
 }
 
-func GetLocation(place string) (*ResMapsHerePlace, error) {
+// URL returns the address of the listing in the Wallapop web.
+func (o *SearchObject) URL() string {
+	return fmt.Sprintf("%v/item/%v", URL, o.WebSlug)
+}
+
+// SoldBy returns true if the seller of the listing is any of sellers, given by
+// user ID or micro name regardless of case.
+func (o *SearchObject) SoldBy(sellers []string) bool {
+	for _, seller := range sellers {
+		if seller == o.User.ID || strings.EqualFold(seller, o.User.MicroName) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIgnored returns true if the title or the description of the listing
+// contains any of the ignores, regardless of case.
+func (o *SearchObject) IsIgnored(ignores []string) bool {
+	title := strings.ToLower(o.Title)
+	description := strings.ToLower(o.Description)
+	for _, ignore := range ignores {
+		ignore = strings.ToLower(ignore)
+		if ignore == "" {
+			continue
+		}
+		if strings.Contains(title, ignore) || strings.Contains(description, ignore) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserStat is a statistic of a user, identified by its type.
+type UserStat struct {
+	Type  string  `json:"type"`
+	Value float32 `json:"value"`
+}
+
+type ResUserStats struct {
+	Ratings  []UserStat `json:"ratings"`
+	Counters []UserStat `json:"counters"`
+}
+
+// Rating returns the average rating of the reviews of the user in stars, from
+// 0 to 5, and the number of reviews.  The API reports the rating from 0 to
+// 100.
+func (s *ResUserStats) Rating() (float32, int) {
+	var rating float32
+	for _, stat := range s.Ratings {
+		if stat.Type == "reviews" {
+			rating = stat.Value / 20
+		}
+	}
+	reviews := 0
+	for _, stat := range s.Counters {
+		if stat.Type == "reviews" {
+			reviews = int(stat.Value)
+		}
+	}
+	return rating, reviews
+}
+
+func GetUserStats(ctx context.Context, userID string) (*ResUserStats, error) {
+	var res ResUserStats
+	if _, err := Get(ctx, fmt.Sprintf("%v/users/%v/stats", apiURL, userID), struct{}{}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func GetLocation(ctx context.Context, place string) (*ResMapsHerePlace, error) {
 	var res ResMapsHerePlace
-	if _, err := Get(fmt.Sprintf("%v/maps/here/place", URL), ReqMapsHerePlace{place}, &res); err != nil {
+	if _, err := Get(ctx, fmt.Sprintf("%v/maps/here/place", URL), ReqMapsHerePlace{place}, &res); err != nil {
 		return nil, err
 	}
 	return &res, nil
 }
 
 type SearchOpts struct {
+	// Age is the age of the oldest results, DefaultSearchAge if unset.
 	Age time.Duration
+	// Since skips the pages with results older than it, which are known
+	// from a previous search.  Requires ordering by newest.
+	Since time.Time
+	// FirstPageOnly stops the search after its first page.
+	FirstPageOnly bool
 }
 
-func Search(opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+func Search(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
 	var res ResSearch
-	// req := *_req
-	// req.Step = 1
-	limit := time.Now().Add(-opts.Age)
-	v, err := query.Values(req)
-	if err != nil {
-		return nil, fmt.Errorf("parsing url params: %w", err)
+	age := opts.Age
+	if age == 0 {
+		age = DefaultSearchAge
 	}
-	params := v.Encode()
+	limit := time.Now().Add(-age)
+	pageReq := *req
 	for {
 		var tmpRes ResSearch
-		resp, err := GetParamsString(fmt.Sprintf("%v/general/search", URLAPIV3),
-			params,
-			// ReqSearch{
-			// 	Distance:      5000,
-			// 	Keywords:      "kindle",
-			// 	FiltersSource: "quick_filters",
-			// 	OrderBy:       "newest",
-			// 	MinSalePrice:  0,
-			// 	MaxSalePrice:  999,
-			// 	Latitude:      41.38804,
-			// 	Longitude:     2.17001,
-			// 	Language:      "es_ES",
-			// },
-			&tmpRes)
+		resp, err := Get(ctx, fmt.Sprintf("%v/general/search", apiURL), pageReq, &tmpRes)
 		if err != nil {
 			return nil, err
 		}
 		res.SearchObjects = append(res.SearchObjects, tmpRes.SearchObjects...)
-		nextPage, err := NewNextPage(resp.Header.Get("X-NextPage"))
+		// The last page has no X-NextPage.
+		rawNextPage := resp.Header.Get("X-NextPage")
+		if rawNextPage == "" {
+			break
+		}
+		nextPage, err := NewNextPage(rawNextPage)
 		if err != nil {
 			return nil, err
 		}
-		if limit.After(nextPage.PaginationDate) {
+		if res.PaginationDate.IsZero() {
+			res.PaginationDate = nextPage.PaginationDate
+		}
+		if opts.FirstPageOnly || limit.After(nextPage.PaginationDate) ||
+			!nextPage.PaginationDate.After(opts.Since) {
 			break
 		}
-		params = nextPage.Raw
-		// req.PaginationDate = nextPage.PaginationDate.Format(time.RFC3339)
-		// req.Step = nextPage.Step
-		// req.SearchID = nextPage.SearchID
+		pageReq.PaginationDate = nextPage.PaginationDate.Format(time.RFC3339)
+		pageReq.Step = nextPage.Step
+		pageReq.SearchID = nextPage.SearchID
 	}
 	return &res, nil
 }
 
-func GetItem(itemID string) (*ResItem, error) {
+func GetItem(ctx context.Context, itemID string) (*ResItem, error) {
 	var res ResItem
-	if _, err := Get(fmt.Sprintf("%v/items/%v", URLAPIV3, itemID),
+	if _, err := Get(ctx, fmt.Sprintf("%v/items/%v", apiURL, itemID),
 		struct{}{}, &res); err != nil {
 		return nil, err
 	}
@@ -360,28 +1329,201 @@ func GetItem(itemID string) (*ResItem, error) {
 	return &res, nil
 }
 
+// GetItems returns the details of the items itemIDs, in the same order, nil
+// for the items that no longer exist.  The Wallapop API has no endpoint to
+// get several items at once, so they are fetched with GetItem, at most
+// concurrency of them at the same time.  On error the items fetched until
+// then are returned along with it.
+func GetItems(ctx context.Context, itemIDs []string, concurrency int) ([]*ResItem, error) {
+	return getItemsWith(ctx, itemIDs, concurrency, GetItem)
+}
+
+// getItemsWith returns the items itemIDs as described in GetItems, fetched
+// with get by at most concurrency goroutines.  The first error other than a
+// missing item cancels the remaining fetches.
+func getItemsWith(ctx context.Context, itemIDs []string, concurrency int,
+	get func(ctx context.Context, itemID string) (*ResItem, error)) ([]*ResItem, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		Index int
+		Item  *ResItem
+		Err   error
+	}
+	jobs := make(chan int)
+	ch := make(chan result)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				item, err := get(ctx, itemIDs[index])
+				ch <- result{Index: index, Item: item, Err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for index := range itemIDs {
+			select {
+			case jobs <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	items := make([]*ResItem, len(itemIDs))
+	var firstErr error
+	for r := range ch {
+		if r.Err != nil {
+			if !isNotFound(r.Err) && firstErr == nil {
+				firstErr = r.Err
+				cancel()
+			}
+			continue
+		}
+		items[r.Index] = r.Item
+	}
+	return items, firstErr
+}
+
+// isNotFound returns whether err is a 404 reply of the Wallapop API, e.g. for
+// a listing that was removed.
+func isNotFound(err error) bool {
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
+
 type FeedsConfig struct {
-	CacheTimeout     time.Duration
-	UpdateQueryDelay time.Duration
+	// Client queries the Wallapop API, HTTPClient if nil.
+	Client       Client
+	CacheTimeout time.Duration
+	// CacheCleanInterval is the interval between the removals of the expired
+	// items from the cache by Run, DefaultCacheCleanInterval if not
+	// positive.
+	CacheCleanInterval time.Duration
+	// UpdateInterval is the interval between the updates of the feeds whose
+	// query doesn't set one, DefaultUpdateInterval if zero.
+	UpdateInterval time.Duration
+	// UpdateJitter randomizes every update interval by up to this fraction
+	// of it, in both directions, so that the feeds updates spread out.
+	UpdateJitter float64
+	// UpdateConcurrency is the maximum number of queries updated at the same
+	// time.
+	UpdateConcurrency int
+	// ItemConcurrency is the maximum number of item details fetched at the
+	// same time by every feed update with the default Client,
+	// DefaultItemConcurrency if zero.
+	ItemConcurrency int
+	// UpdateTimeout is the deadline for generating a single feed.  A feed
+	// that times out keeps its previous version.  Zero means no deadline.
+	UpdateTimeout time.Duration
+	// Notifiers are notified of the new items of every feed update.
+	Notifiers []Notifier
+	// SeenPath is the file where the seen item IDs are persisted after every
+	// update.  Empty disables persistence.
+	SeenPath string
+	// Store records the listings of every feed update when not nil.
+	Store Store
+	// FeedAuthorName, FeedAuthorEmail and FeedLink are the author and link
+	// of the feeds, DefaultFeedAuthorName, DefaultFeedAuthorEmail and
+	// DefaultFeedLink if empty.
+	FeedAuthorName  string
+	FeedAuthorEmail string
+	FeedLink        string
+	// NoImages leaves the images out of the items of the queries that don't
+	// set include_images.
+	NoImages bool
+	// OutputDir is the directory where the RSS of every feed is written to
+	// <name>.xml after every update.  Empty disables it.
+	OutputDir string
+	// IncrementalSearch only fetches the search pages newer than the
+	// previous update, keeping the older results of the previous updates.
+	IncrementalSearch bool
+}
+
+// FeedStatus describes the outcome of the latest updates of a feed.
+type FeedStatus struct {
+	Name string `json:"name"`
+	// LastUpdated is the time of the last successful update.
+	LastUpdated time.Time `json:"last_updated"`
+	// Items is the number of items in the feed being served.
+	Items int `json:"items"`
+	// LastError is the error of the last update, empty if it succeeded.
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	// ConsecutiveFailures is the number of updates that failed in a row,
+	// which back off the next update.
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// NextUpdate is the time the feed is due to be updated.
+	NextUpdate time.Time `json:"next_update"`
 }
 
 type Feeds struct {
 	queries   *Queries
 	itemCache *Cache
-	feeds     map[string]*feeds.Feed
-	cfg       FeedsConfig
-	m         sync.RWMutex
+	// userCache has the ResUserStats of the sellers by user ID.
+	userCache *Cache
+	feeds     map[string]*renderedFeed
+	status    map[string]FeedStatus
+	// seen has the item IDs of every feed seen in previous updates.
+	seen map[string]map[string]bool
+	// newItems has the items of every feed that appeared in its latest
+	// update.
+	newItems map[string][]NewItem
+	// next has the time every feed is due to be updated by Run.
+	next map[string]time.Time
+	// cursors has the state of the incremental searches by feed name and
+	// search request.
+	cursors map[string]map[string]*searchCursor
+	cfg     FeedsConfig
+	m       sync.RWMutex
+	// notifying tracks the notifications being sent.
+	notifying sync.WaitGroup
+	// genFeedFn generates the feed of a query.  It's f.genFeed except in
+	// tests.
+	genFeedFn func(ctx context.Context, query *Query) (*feeds.Feed, error)
+	client    Client
+}
+
+// renderedFeed is a feed together with its RSS rendering, so that it's not
+// rendered on every request.
+type renderedFeed struct {
+	Feed *feeds.Feed
+	RSS  []byte
 }
 
 func NewFeeds(queries *Queries, cfg FeedsConfig) *Feeds {
-	return &Feeds{
-		queries: queries,
-		itemCache: NewCache(
-			func(key string) (interface{}, error) { return GetItem(key) },
-			cfg.CacheTimeout),
-		feeds: make(map[string]*feeds.Feed),
-		cfg:   cfg,
+	f := &Feeds{
+		queries:  queries,
+		client:   cfg.Client,
+		feeds:    make(map[string]*renderedFeed),
+		status:   make(map[string]FeedStatus),
+		seen:     make(map[string]map[string]bool),
+		newItems: make(map[string][]NewItem),
+		next:     make(map[string]time.Time),
+		cursors:  make(map[string]map[string]*searchCursor),
+		cfg:      cfg,
+	}
+	if f.client == nil {
+		f.client = HTTPClient{ItemConcurrency: cfg.ItemConcurrency}
 	}
+	f.itemCache = NewCache(
+		func(ctx context.Context, key string) (interface{}, error) { return f.client.GetItem(ctx, key) },
+		cfg.CacheTimeout)
+	f.userCache = NewCache(
+		func(ctx context.Context, key string) (interface{}, error) { return f.client.GetUserStats(ctx, key) },
+		cfg.CacheTimeout)
+	f.genFeedFn = f.genFeed
+	return f
 }
 
 var (
@@ -395,112 +1537,732 @@ func (f *Feeds) Get(name string) (*feeds.Feed, error) {
 	if !ok {
 		return nil, ErrFeedNotFound
 	}
-	return feed, nil
+	return feed.Feed, nil
+}
+
+// GetRSS returns the feed name rendered as RSS.
+func (f *Feeds) GetRSS(name string) ([]byte, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	feed, ok := f.feeds[name]
+	if !ok {
+		return nil, ErrFeedNotFound
+	}
+	return feed.RSS, nil
+}
+
+// Status returns the update status of every feed sorted by name.
+func (f *Feeds) Status() []FeedStatus {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	status := make([]FeedStatus, 0, len(f.status))
+	for name, s := range f.status {
+		s.Name = name
+		if feed, ok := f.feeds[name]; ok {
+			s.Items = len(feed.Feed.Items)
+		}
+		s.NextUpdate = f.next[name]
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// enabledQueries returns the enabled queries, removing the feeds of the
+// disabled ones.
+func (f *Feeds) enabledQueries(queries map[string]Query) map[string]Query {
+	enabled := make(map[string]Query, len(queries))
+	f.m.Lock()
+	defer f.m.Unlock()
+	for name, query := range queries {
+		if query.enabled() {
+			enabled[name] = query
+		} else {
+			f.remove(name)
+		}
+	}
+	return enabled
+}
+
+// remove removes the feed name and the state of its incremental searches,
+// keeping its seen items.  f.m must be held.
+func (f *Feeds) remove(name string) {
+	delete(f.feeds, name)
+	delete(f.status, name)
+	delete(f.newItems, name)
+	delete(f.next, name)
+	delete(f.cursors, name)
+}
+
+// CacheStats returns the counters of the item cache.
+func (f *Feeds) CacheStats() CacheStats {
+	return f.itemCache.Stats()
 }
 
-func (f *Feeds) Update() {
+// prune removes the feeds and the seen items of the queries that were removed.
+func (f *Feeds) prune() {
 	queries := f.queries.Get()
+	f.m.Lock()
+	defer f.m.Unlock()
+	for name := range f.status {
+		if _, ok := queries[name]; !ok {
+			f.remove(name)
+			delete(f.seen, name)
+		}
+	}
+}
+
+// Update regenerates the feeds of all the queries, running at most
+// cfg.UpdateConcurrency of them at the same time.  Feeds that fail to update
+// keep their previous version.  Once ctx is done no more feeds are updated,
+// and Update returns when the updates in progress stop.
+func (f *Feeds) Update(ctx context.Context) {
+	f.prune()
+	f.update(ctx, f.queries.Get())
+}
+
+// UpdateChanged updates the feeds of the queries added or changed since old,
+// the queries returned by Queries.Get before reloading them.
+func (f *Feeds) UpdateChanged(ctx context.Context, old map[string]Query) {
+	f.prune()
+	changed := make(map[string]Query)
+	for name, query := range f.queries.Get() {
+		if prev, ok := old[name]; !ok || !reflect.DeepEqual(prev, query) {
+			changed[name] = query
+		}
+	}
+	if len(changed) != 0 {
+		f.update(ctx, changed)
+	}
+}
+
+// update regenerates the feeds of queries as described in Update and
+// schedules their next update.
+func (f *Feeds) update(ctx context.Context, queries map[string]Query) {
+	queries = f.enabledQueries(queries)
+	type NameAndQuery struct {
+		Name  string
+		Query Query
+	}
 	type NameAndFeed struct {
-		Name string
-		Feed *feeds.Feed
+		Name  string
+		Query Query
+		Feed  *renderedFeed
+		Err   error
 	}
+	jobs := make(chan NameAndQuery)
 	ch := make(chan NameAndFeed)
-	for name, query := range queries {
-		go func(name string, query Query) {
-			feed, err := f.genFeed(&query)
-			if err != nil {
-				log.WithError(err).WithField("name", name).Error("Unable to generate feed")
-				ch <- NameAndFeed{Feed: nil, Name: name}
-				return
+	workers := f.cfg.UpdateConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.Query.name = job.Name
+				feed, err := f.updateFeed(ctx, &job.Query)
+				if err != nil {
+					log.WithError(err).WithField("name", job.Name).Error("Unable to generate feed")
+					ch <- NameAndFeed{Feed: nil, Name: job.Name, Query: job.Query, Err: err}
+					continue
+				}
+				ch <- NameAndFeed{Feed: feed, Name: job.Name, Query: job.Query}
 			}
-			ch <- NameAndFeed{Feed: feed, Name: name}
-		}(name, query)
-		time.Sleep(f.cfg.UpdateQueryDelay)
+		}()
 	}
-	for i := 0; i < len(queries); i++ {
-		select {
-		case NameAndFeed := <-ch:
-			if NameAndFeed.Feed == nil {
-				continue
+	go func() {
+		defer close(jobs)
+		for name, query := range queries {
+			if ctx.Err() != nil {
+				return
 			}
-			f.m.Lock()
+			select {
+			case jobs <- NameAndQuery{Name: name, Query: query}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	for NameAndFeed := range ch {
+		if NameAndFeed.Err != nil && ctx.Err() != nil {
+			// Cancelled by the caller, e.g. on shutdown, not a failure.
+			continue
+		}
+		var writeErr error
+		if NameAndFeed.Err == nil && f.cfg.OutputDir != "" {
+			writeErr = writeRSSFile(f.cfg.OutputDir, NameAndFeed.Name, NameAndFeed.Feed.RSS)
+			if writeErr != nil {
+				log.WithError(writeErr).WithField("name", NameAndFeed.Name).Error("Unable to write feed")
+			}
+		}
+		now := time.Now()
+		var items []NewItem
+		f.m.Lock()
+		status := f.status[NameAndFeed.Name]
+		if NameAndFeed.Err != nil {
+			status.LastError = NameAndFeed.Err.Error()
+			status.LastErrorTime = now
+			status.ConsecutiveFailures++
+		} else {
 			f.feeds[NameAndFeed.Name] = NameAndFeed.Feed
-			f.m.Unlock()
+			status.LastUpdated = now
+			status.LastError = ""
+			status.ConsecutiveFailures = 0
+			items = newItems(NameAndFeed.Name, f.markSeen(NameAndFeed.Name, NameAndFeed.Feed.Feed,
+				NameAndFeed.Query.NotifyOnFirstRun))
+			f.newItems[NameAndFeed.Name] = items
+			if writeErr != nil {
+				status.LastError = writeErr.Error()
+				status.LastErrorTime = now
+			}
+		}
+		f.status[NameAndFeed.Name] = status
+		interval := backoff(f.updateInterval(&NameAndFeed.Query), status.ConsecutiveFailures)
+		f.next[NameAndFeed.Name] = now.Add(f.jitter(interval))
+		f.m.Unlock()
+		if len(items) != 0 && len(f.cfg.Notifiers) != 0 {
+			f.notifying.Add(1)
+			go func(query Query) {
+				defer f.notifying.Done()
+				f.notify(ctx, &query, items)
+			}(NameAndFeed.Query)
+		}
+	}
+	if f.cfg.SeenPath != "" {
+		if err := f.saveSeen(); err != nil {
+			log.WithError(err).WithField("file", f.cfg.SeenPath).Error("Unable to save seen items")
 		}
+	}
+}
 
+// updateFeed generates and renders the feed of query within
+// cfg.UpdateTimeout.
+func (f *Feeds) updateFeed(ctx context.Context, query *Query) (*renderedFeed, error) {
+	if f.cfg.UpdateTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.cfg.UpdateTimeout)
+		defer cancel()
+	}
+	feed, err := f.genFeedFn(ctx, query)
+	if err != nil {
+		return nil, err
 	}
+	rss, err := ToRSS(feed)
+	if err != nil {
+		return nil, fmt.Errorf("rendering rss: %w", err)
+	}
+	return &renderedFeed{Feed: feed, RSS: []byte(rss)}, nil
 }
 
-func (f *Feeds) genFeed(query *Query) (*feeds.Feed, error) {
-	now := time.Now()
-	feed := feeds.Feed{
-		Title:       fmt.Sprintf("%v - Wallapop RSS v2", query.Keywords),
-		Link:        &feeds.Link{Href: "http://es.wallapop.com"},
-		Description: "Wallapop RSS feed.",
-		Author:      &feeds.Author{Name: "Dhole", Email: "dhole@riseup.net"},
-		Created:     now,
-		Updated:     now,
-		Items:       make([]*feeds.Item, 0),
+func (f *Feeds) genFeed(ctx context.Context, query *Query) (*feeds.Feed, error) {
+	objects, err := f.queryObjects(ctx, query, f.search)
+	if err != nil {
+		return nil, err
 	}
-	location, err := GetLocation(query.LocationName)
+	if f.cfg.Store != nil {
+		if err := f.cfg.Store.Record(ctx, objects, time.Now()); err != nil {
+			log.WithError(err).Error("Unable to record items")
+		}
+	}
+	items, err := f.fetchItems(ctx, objects)
 	if err != nil {
 		return nil, err
 	}
-	itemIDs := make(map[string]bool)
-	for _, keyword := range query.Keywords {
-		result, err := Search(
-			SearchOpts{Age: 15 * 24 * time.Hour},
-			&ReqSearch{
-				Distance:      float32(query.LocationRadius * 1000),
-				Keywords:      keyword,
-				FiltersSource: "quick_filters",
-				OrderBy:       "newest",
-				MinSalePrice:  query.MinPrice,
-				MaxSalePrice:  query.MaxPrice,
-				Latitude:      location.Latitude,
-				Longitude:     location.Longitude,
-				Language:      "es_ES",
-			},
-		)
-		if err != nil {
-			return nil, err
+	f.dropRemoved(query, objects, items)
+	return f.buildFeed(query, objects, items, time.Now()), nil
+}
+
+// dropRemoved removes the listings objects that no longer exist, those
+// without items, from the incremental searches of query, so that they aren't
+// kept until they are too old.
+func (f *Feeds) dropRemoved(query *Query, objects []SearchObject, items map[string]*ResItem) {
+	removed := make(map[string]bool)
+	for _, object := range objects {
+		if _, ok := items[object.ID]; !ok {
+			removed[object.ID] = true
 		}
-		items := result.SearchObjects
-		for _, item := range items {
-			if _, ok := itemIDs[item.ID]; ok {
+	}
+	if len(removed) == 0 {
+		return
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, cursor := range f.cursors[query.name] {
+		kept := make([]SearchObject, 0, len(cursor.Objects))
+		for _, object := range cursor.Objects {
+			if removed[object.ID] {
+				delete(cursor.found, object.ID)
 				continue
 			}
-			ignoreItem := false
-			for _, ignore := range query.Ignores {
-				if strings.Contains(item.Description, ignore) {
-					ignoreItem = true
-					break
-				}
-			}
-			if ignoreItem {
-				continue
+			kept = append(kept, object)
+		}
+		cursor.Objects = kept
+	}
+}
+
+// SearchFeed generates the feed of a query on the fly, within
+// cfg.UpdateTimeout.  Unlike the feeds of the queries, it's not stored, its
+// items are not recorded nor notified and its search is never incremental.
+func (f *Feeds) SearchFeed(ctx context.Context, query *Query) (*feeds.Feed, error) {
+	ctx, cancel := f.onDemandContext(ctx)
+	defer cancel()
+	objects, err := f.queryObjects(ctx, query, f.searchAll)
+	if err != nil {
+		return nil, err
+	}
+	return f.itemsFeed(ctx, query, objects)
+}
+
+// onDemandContext returns the context of an on-demand search, which has the
+// deadline of a feed update and is limited by SetSearchRateLimit.
+func (f *Feeds) onDemandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = onDemand(ctx)
+	if f.cfg.UpdateTimeout != 0 {
+		return context.WithTimeout(ctx, f.cfg.UpdateTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// queryObjects returns the listings of the feed of query, running the
+// searches with search.
+func (f *Feeds) queryObjects(ctx context.Context, query *Query,
+	search func(ctx context.Context, query *Query, req *ReqSearch) ([]SearchObject, error)) ([]SearchObject, error) {
+	var objects []SearchObject
+	for _, l := range query.locations() {
+		location := &ResMapsHerePlace{Latitude: l.Latitude, Longitude: l.Longitude}
+		if !l.hasCoordinates() {
+			var err error
+			location, err = f.client.GetLocation(ctx, l.Name)
+			if err != nil {
+				return nil, err
 			}
-			itemDataEntry, err := f.itemCache.Get(item.ID)
+		}
+		for _, keyword := range query.Keywords {
+			result, err := search(ctx, query, query.searchRequest(keyword, l, location))
 			if err != nil {
 				return nil, err
 			}
-			itemData := itemDataEntry.(*ResItem)
-			description := item.Description + "<br/>"
-			for _, image := range itemData.Images {
-				src := fmt.Sprintf("%v1024", strings.TrimSuffix(image.URLs.Big, "800"))
-				description += fmt.Sprintf(`<img src="%v"><br/>`, src)
+			objects = append(objects, result...)
+		}
+	}
+	return f.filterSellerRating(ctx, query, filterItems(objects, query))
+}
+
+// filterSellerRating drops the listings of objs sold by sellers rated below
+// q.MinSellerRating.  The ratings that the search results don't report are
+// fetched.
+func (f *Feeds) filterSellerRating(ctx context.Context, q *Query, objs []SearchObject) ([]SearchObject, error) {
+	if q.MinSellerRating == 0 {
+		return objs, nil
+	}
+	kept := make([]SearchObject, 0, len(objs))
+	for _, obj := range objs {
+		rating, reviews := obj.User.Rating, obj.User.Reviews
+		if rating == nil {
+			entry, err := f.userCache.Get(ctx, obj.User.ID)
+			if err != nil {
+				return nil, fmt.Errorf("getting the rating of seller %v: %w", obj.User.ID, err)
+			}
+			stars, n := entry.(*ResUserStats).Rating()
+			rating, reviews = &stars, n
+		}
+		// A zero rating without reviews is a seller without reviews.
+		if (*rating != 0 || reviews != 0) && *rating < q.MinSellerRating {
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept, nil
+}
+
+// maxSalePrice returns the maximum price of the search, nil if unlimited.
+func (q *Query) maxSalePrice() *int {
+	if q.MaxPrice == 0 && !q.maxPriceZero {
+		return nil
+	}
+	maxPrice := q.MaxPrice
+	return &maxPrice
+}
+
+// searchRequest returns the request of the search of keyword around
+// location, the coordinates of l.
+func (q *Query) searchRequest(keyword string, l Location, location *ResMapsHerePlace) *ReqSearch {
+	return &ReqSearch{
+		Distance:      q.searchDistance(l.Radius),
+		Keywords:      keyword,
+		FiltersSource: "quick_filters",
+		OrderBy:       "newest",
+		MinSalePrice:  q.MinPrice,
+		MaxSalePrice:  q.maxSalePrice(),
+		IsShippable:   q.ShippingOnly,
+		CategoryIDs:   q.categoryIDs(),
+		Latitude:      location.Latitude,
+		Longitude:     location.Longitude,
+		Language:      q.language(),
+	}
+}
+
+// DebugSearch sends the request of the first page of the search of the first
+// keyword and location of q and returns the response as received.
+func (f *Feeds) DebugSearch(ctx context.Context, q *Query) (*RawResponse, error) {
+	ctx, cancel := f.onDemandContext(ctx)
+	defer cancel()
+	l := q.locations()[0]
+	location := &ResMapsHerePlace{Latitude: l.Latitude, Longitude: l.Longitude}
+	if !l.hasCoordinates() {
+		var err error
+		location, err = f.client.GetLocation(ctx, l.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	params, err := query.Values(q.searchRequest(q.Keywords[0], l, location))
+	if err != nil {
+		return nil, fmt.Errorf("parsing url params: %w", err)
+	}
+	return GetRaw(ctx, fmt.Sprintf("%v/general/search", apiURL), params.Encode())
+}
+
+// itemsFeed returns the feed of query with the listings objects.
+func (f *Feeds) itemsFeed(ctx context.Context, query *Query, objects []SearchObject) (*feeds.Feed, error) {
+	items, err := f.fetchItems(ctx, objects)
+	if err != nil {
+		return nil, err
+	}
+	return f.buildFeed(query, objects, items, time.Now()), nil
+}
+
+// fetchItems returns the details of the listings objects by ID, without the
+// listings that no longer exist.  The ones not in the cache are fetched at
+// once with Client.GetItems, and cached even if others fail.
+func (f *Feeds) fetchItems(ctx context.Context, objects []SearchObject) (map[string]*ResItem, error) {
+	items := make(map[string]*ResItem, len(objects))
+	lookedUp := make(map[string]bool, len(objects))
+	var missing []string
+	for _, object := range objects {
+		if lookedUp[object.ID] {
+			continue
+		}
+		lookedUp[object.ID] = true
+		if entry, ok := f.itemCache.Lookup(object.ID); ok {
+			// A nil item is a listing that no longer exists.
+			if item := entry.(*ResItem); item != nil {
+				items[object.ID] = item
+			}
+			continue
+		}
+		missing = append(missing, object.ID)
+	}
+	if len(missing) == 0 {
+		return items, nil
+	}
+	fetched, err := f.client.GetItems(ctx, missing)
+	for i, item := range fetched {
+		if item == nil && err != nil {
+			// Either missing or not fetched because of err.
+			continue
+		}
+		// The missing listings are cached too, so that they aren't
+		// requested on every update.
+		f.itemCache.Put(missing[i], item)
+		if item != nil {
+			items[missing[i]] = item
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// buildFeed returns the feed of query generated at now with the listings
+// objects, whose details are in items by ID.  The objects not in items are
+// left out.
+func (f *Feeds) buildFeed(query *Query, objects []SearchObject, items map[string]*ResItem,
+	now time.Time) *feeds.Feed {
+	feed := feeds.Feed{
+		Title:       fmt.Sprintf("%v - Wallapop RSS v2", query.Keywords),
+		Link:        &feeds.Link{Href: orDefault(f.cfg.FeedLink, DefaultFeedLink)},
+		Description: "Wallapop RSS feed.",
+		Author: &feeds.Author{
+			Name:  orDefault(f.cfg.FeedAuthorName, DefaultFeedAuthorName),
+			Email: orDefault(f.cfg.FeedAuthorEmail, DefaultFeedAuthorEmail),
+		},
+		Created: now,
+		Updated: now,
+		Items:   make([]*feeds.Item, 0),
+	}
+	for _, item := range objects {
+		itemData, ok := items[item.ID]
+		if !ok {
+			// The listing no longer exists.
+			continue
+		}
+		date := time.Unix(itemData.ModifiedDate, 0)
+		var images []string
+		if f.includeImages(query) {
+			images = itemImages(&item, itemData, query)
+		}
+		feedItem := &feeds.Item{
+			Id:          item.ID,
+			Title:       itemTitle(&item, query),
+			Link:        &feeds.Link{Href: item.URL()},
+			Description: itemDescription(&item, images, query),
+			Author:      &feeds.Author{Name: item.User.MicroName},
+			Created:     date,
+			Updated:     date,
+		}
+		if query.MediaThumbnails && len(images) != 0 {
+			// Rendered as a Media RSS thumbnail by ToRSS.
+			feedItem.Enclosure = &feeds.Enclosure{Url: images[0], Type: "image/jpeg"}
+		}
+		feed.Items = append(feed.Items, feedItem)
+	}
+	return &feed
+}
+
+// searchCursor is the state of an incremental search.
+type searchCursor struct {
+	// PaginationDate is the ResSearch.PaginationDate of the latest search.
+	PaginationDate time.Time
+	Objects        []SearchObject
+	// found has the time every object was first found.
+	found map[string]time.Time
+}
+
+// nextCursor returns the cursor that follows prev (nil for the first search)
+// after the search res.  The objects of prev not in res are kept until limit
+// after they were first found.
+func nextCursor(prev *searchCursor, res *ResSearch, now, limit time.Time) *searchCursor {
+	next := &searchCursor{PaginationDate: res.PaginationDate, found: make(map[string]time.Time)}
+	add := func(object SearchObject, found time.Time) {
+		if _, ok := next.found[object.ID]; ok {
+			return
+		}
+		next.found[object.ID] = found
+		next.Objects = append(next.Objects, object)
+	}
+	for _, object := range res.SearchObjects {
+		found := now
+		if prev != nil {
+			if t, ok := prev.found[object.ID]; ok {
+				found = t
+			}
+		}
+		add(object, found)
+	}
+	if prev != nil {
+		for _, object := range prev.Objects {
+			if found := prev.found[object.ID]; !found.Before(limit) {
+				add(object, found)
 			}
-			date := time.Unix(itemData.ModifiedDate, 0)
-			feed.Items = append(feed.Items, &feeds.Item{
-				Id:          item.ID,
-				Title:       fmt.Sprintf("%v - %v %v", item.Title, item.Price, item.Currency),
-				Link:        &feeds.Link{Href: fmt.Sprintf("%v/item/%v", URL, item.WebSlug)},
-				Description: description,
-				Author:      &feeds.Author{Name: item.User.MicroName},
-				Created:     date,
-				Updated:     date,
-			})
-		}
-	}
-	return &feed, nil
+		}
+	}
+	return next
+}
+
+// searchAll returns all the results of req for query.
+func (f *Feeds) searchAll(ctx context.Context, query *Query, req *ReqSearch) ([]SearchObject, error) {
+	res, err := f.client.Search(ctx, query.searchOpts(), req)
+	if err != nil {
+		return nil, err
+	}
+	return res.SearchObjects, nil
+}
+
+// searchKey returns the key of the incremental search of req, its encoded
+// parameters.
+func searchKey(req *ReqSearch) (string, error) {
+	v, err := query.Values(req)
+	if err != nil {
+		return "", fmt.Errorf("parsing url params: %w", err)
+	}
+	return v.Encode(), nil
+}
+
+// search returns the results of req for query.  With cfg.IncrementalSearch
+// it resumes the previous search of req.
+func (f *Feeds) search(ctx context.Context, query *Query, req *ReqSearch) ([]SearchObject, error) {
+	if !f.cfg.IncrementalSearch {
+		return f.searchAll(ctx, query, req)
+	}
+	opts := query.searchOpts()
+	key, err := searchKey(req)
+	if err != nil {
+		return nil, err
+	}
+	f.m.RLock()
+	prev := f.cursors[query.name][key]
+	f.m.RUnlock()
+	if prev != nil {
+		opts.Since = prev.PaginationDate
+	}
+	res, err := f.client.Search(ctx, opts, req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	next := nextCursor(prev, res, now, now.Add(-opts.Age))
+	f.m.Lock()
+	if f.cursors[query.name] == nil {
+		f.cursors[query.name] = make(map[string]*searchCursor)
+	}
+	f.cursors[query.name][key] = next
+	f.m.Unlock()
+	return next.Objects, nil
+}
+
+// orDefault returns value, or def if value is empty.
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// itemTitle returns the title of the feed item of a listing.
+func itemTitle(item *SearchObject, query *Query) string {
+	title := fmt.Sprintf("%v - %v %v", item.Title, item.Price, item.Currency)
+	if query.MarkStatus {
+		if item.Flags.Sold {
+			title = "[SOLD] " + title
+		} else if item.Flags.Reserved {
+			title = "[RESERVED] " + title
+		}
+	}
+	return title
+}
+
+// imageSuffixes returns the suffix of the big image URLs of the query and
+// its replacement.
+func (q *Query) imageSuffixes() (from, to string) {
+	from, to = orDefault(q.ImageFrom, DefaultImageFrom), q.ImageTo
+	if to == "" {
+		size := q.ImageSize
+		if size == 0 {
+			size = DefaultImageSize
+		}
+		to = strconv.Itoa(size)
+	}
+	return from, to
+}
+
+// imageURL returns the address of the big item image with the suffix from,
+// usually its resolution, replaced by to.  URLs that don't end in from
+// (including other resolutions that happen to end in a numeric from, e.g.
+// 1800 for 800) are returned unchanged.
+func imageURL(big, from, to string) string {
+	prefix := strings.TrimSuffix(big, from)
+	if prefix == big {
+		return big
+	}
+	if prefix != "" && unicode.IsDigit(rune(from[0])) && unicode.IsDigit(rune(prefix[len(prefix)-1])) {
+		return big
+	}
+	return prefix + to
+}
+
+// includeImages returns whether the items of the feed of query have images.
+func (f *Feeds) includeImages(query *Query) bool {
+	if query.IncludeImages != nil {
+		return *query.IncludeImages
+	}
+	return !f.cfg.NoImages
+}
+
+// itemDescription returns the HTML description of the feed item of a listing:
+// its text, truncated to query.MaxDescriptionChars, and its category if known,
+// followed by the images.  The text is escaped, as it's written by the seller
+// and may contain HTML.
+func itemDescription(item *SearchObject, images []string, query *Query) string {
+	description := html.EscapeString(truncate(item.Description, query.MaxDescriptionChars)) + "<br/>"
+	if item.CategoryID != 0 {
+		description += fmt.Sprintf("Category: %v<br/>", item.CategoryID)
+	}
+	for _, src := range images {
+		description += fmt.Sprintf(`<img src="%v"><br/>`, html.EscapeString(src))
+	}
+	return description
+}
+
+// truncate returns text cut to max characters ending in an ellipsis, or text
+// if it's not longer or max is zero.
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if max == 0 || len(runes) <= max {
+		return text
+	}
+	return strings.TrimRightFunc(string(runes[:max-1]), unicode.IsSpace) + "…"
+}
+
+// itemImages returns the image URLs of a listing, at most query.MaxImages.
+// The images of the item details are preferred, falling back to the ones of
+// the search result when the details have none.
+func itemImages(item *SearchObject, itemData *ResItem, query *Query) []string {
+	from, to := query.imageSuffixes()
+	var images []string
+	for _, image := range itemData.Images {
+		if image.URLs.Big != "" {
+			images = append(images, imageURL(image.URLs.Big, from, to))
+		}
+	}
+	if len(images) == 0 {
+		for _, image := range item.Images {
+			if image.Original != "" {
+				images = append(images, image.Original)
+			}
+		}
+	}
+	if query.MaxImages != 0 && len(images) > query.MaxImages {
+		images = images[:query.MaxImages]
+	}
+	return images
+}
+
+// filterItems returns the search results that belong in the feed of q: the
+// first occurrence of every listing that is not ignored and is within
+// q.MaxDistanceKm, the price range and q.Currency,
+// since the search doesn't always honor them, and is sold by the allowed
+// sellers.  Listings are identified by ID, as the same listing can be returned
+// with different slugs by different keywords and locations.
+func filterItems(objs []SearchObject, q *Query) []SearchObject {
+	seen := make(map[string]bool)
+	kept := make([]SearchObject, 0, len(objs))
+	for _, obj := range objs {
+		if seen[obj.ID] {
+			continue
+		}
+		seen[obj.ID] = true
+		if obj.IsIgnored(q.Ignores) {
+			continue
+		}
+		if obj.SoldBy(q.IgnoreSellers) || (len(q.OnlySellers) != 0 && !obj.SoldBy(q.OnlySellers)) {
+			continue
+		}
+		if q.MaxDistanceKm != 0 && obj.Distance > q.MaxDistanceKm {
+			continue
+		}
+		if maxPrice := q.maxSalePrice(); obj.Price < float32(q.MinPrice) ||
+			(maxPrice != nil && obj.Price > float32(*maxPrice)) {
+			continue
+		}
+		if q.Currency != "" && !strings.EqualFold(obj.Currency, q.Currency) {
+			continue
+		}
+		if q.ShippingOnly && !obj.Shippable() {
+			continue
+		}
+		if !q.inCategories(obj.CategoryID) {
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	return kept
 }
@@ -1,17 +1,1184 @@
 package walla
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/go-querystring/query"
+	gfeeds "github.com/gorilla/feeds"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func TestSign(t *testing.T) {
+	url := "/api/v3/suggesters/search"
+	method := "get"
+	timestamp := "1565827270558"
+	sig := sign(url, method, timestamp)
+	assert.Equal(t, "6iU/x0HyEqX2dzMTdv1QsTtBX4Z8tZTuHJmhzMXnxuU=", sig)
+	assert.Nil(t, CheckSigning())
+	assert.False(t, CustomSigning())
+}
+
+func TestSetSigning(t *testing.T) {
+	defer SetSigning("", "")
+	url := "/api/v3/suggesters/search"
+	timestamp := "1565827270558"
+	def := sign(url, "get", timestamp)
+
+	require.Nil(t, SetSigning("{timestamp}|{method}|{path}", ""))
+	assert.True(t, CustomSigning())
+	reordered := sign(url, "get", timestamp)
+	assert.NotEqual(t, def, reordered)
+	assert.Equal(t, signMessage("{timestamp}|{method}|{path}", KEY, url, "get", timestamp), reordered)
+
+	require.Nil(t, SetSigning("", "new key"))
+	assert.True(t, CustomSigning())
+	rekeyed := sign(url, "get", timestamp)
+	assert.NotEqual(t, def, rekeyed)
+	assert.NotEqual(t, reordered, rekeyed)
+	// The reference signature is always checked with the default scheme.
+	assert.Nil(t, CheckSigning())
+
+	assert.Error(t, SetSigning("{method}|{path}|", ""))
+	require.Nil(t, SetSigning("", ""))
+	assert.False(t, CustomSigning())
+	assert.Equal(t, def, sign(url, "get", timestamp))
+}
+
+func TestSignQuery(t *testing.T) {
+	defer SetSignQuery(false)
+	path := "https://api.wallapop.com/api/v3/general/search"
+	params := "start=40&keywords=gameboy&latitude=40.4&keywords=nintendo"
+	timestamp := "1565827270558"
+
+	assert.Equal(t, sign(path, "get", timestamp), signAt(path, params, "get", timestamp))
+	assert.False(t, CustomSigning())
+
+	SetSignQuery(true)
+	assert.True(t, CustomSigning())
+	signed := signAt(path, params, "get", timestamp)
+	assert.Equal(t, sign(path+"?keywords=gameboy&keywords=nintendo&latitude=40.4&start=40", "get", timestamp), signed)
+	assert.NotEqual(t, sign(path, "get", timestamp), signed)
+	// The order of the parameters doesn't change the signature.
+	assert.Equal(t, signed, signAt(path, "keywords=gameboy&latitude=40.4&keywords=nintendo&start=40", "get", timestamp))
+	assert.Equal(t, sign(path, "get", timestamp), signAt(path, "", "get", timestamp))
+}
+
+func TestLoadValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[good]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+max_price = 100
+
+[coords]
+keywords = ["kindle"]
+latitude = 41.38
+longitude = 2.17
+location_radius = 5
+language = "it_IT"
+
+[bad]
+keywords = []
+location_radius = 0
+min_price = -1
+language = "xx_XX"
+
+[empty]
+`), 0644))
+
+	_, err := NewQueries(path)
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []string{
+		`query "bad": no keywords, no location_name nor coordinates, ` +
+			`location_radius must be positive, negative min_price, ` +
+			`unknown language "xx_XX"`,
+		`query "empty": no keywords, no location_name nor coordinates, ` +
+			`location_radius must be positive`,
+	}, validationErr.Problems)
+}
+
+func TestLoadInvertedPriceRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[inverted]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+min_price = 300
+max_price = 100
+`), 0644))
+
+	_, err := NewQueries(path)
+	require.Error(t, err)
+	assert.Equal(t, `invalid queries: query "inverted": `+
+		`min_price (300) is greater than max_price (100)`, err.Error())
+}
+
+func TestSearchRequestKey(t *testing.T) {
+	for _, q := range []Query{
+		{MaxPrice: 50},
+		{maxPriceZero: true},
+		{},
+	} {
+		// The requests of the same search are equal and resume the same
+		// incremental search, even with MaxSalePrice set.
+		l := q.locations()[0]
+		a := q.searchRequest("sofa", l, &ResMapsHerePlace{})
+		b := q.searchRequest("sofa", l, &ResMapsHerePlace{})
+		assert.Equal(t, a, b)
+		keyA, err := searchKey(a)
+		require.Nil(t, err)
+		keyB, err := searchKey(b)
+		require.Nil(t, err)
+		assert.Equal(t, keyA, keyB)
+	}
+}
+
+func TestLoadPricePresets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[cheap]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+price_preset = "under_50"
+
+[free]
+keywords = ["sofa"]
+location_name = "Barcelona"
+location_radius = 5
+free_only = true
+`), 0644))
+	queries, err := NewQueries(path)
+	require.Nil(t, err)
+	cheap := queries.Get()["cheap"]
+	assert.Equal(t, 0, cheap.MinPrice)
+	assert.Equal(t, 50, cheap.MaxPrice)
+	free := queries.Get()["free"]
+	assert.True(t, free.FreeOnly)
+	assert.Equal(t, []SearchObject{{ID: "1"}}, filterItems([]SearchObject{{ID: "1"}, {ID: "2", Price: 5}}, &free))
+
+	// The search of free_only is capped at 0, unlike the unlimited one.
+	l := free.locations()[0]
+	params, err := query.Values(free.searchRequest("sofa", l, &ResMapsHerePlace{}))
+	require.Nil(t, err)
+	assert.Equal(t, []string{"0"}, params["max_sale_price"])
+	unlimited := Query{}
+	params, err = query.Values(unlimited.searchRequest("sofa", l, &ResMapsHerePlace{}))
+	require.Nil(t, err)
+	assert.NotContains(t, params, "max_sale_price")
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[bad]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+price_preset = "cheap"
+max_price = 20
+free_only = true
+`), 0644))
+	_, err = NewQueries(path)
+	require.Error(t, err)
+	assert.Equal(t, `invalid queries: query "bad": unknown price_preset "cheap", `+
+		`price_preset can't be combined with min_price or max_price, `+
+		`free_only can't be combined with a price range`, err.Error())
+}
+
+func TestLoadLocations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[cities]
+keywords = ["kindle"]
+
+[[cities.locations]]
+name = "Madrid"
+radius = 10
+
+[[cities.locations]]
+latitude = 41.38
+longitude = 2.17
+radius = 5
+`), 0644))
+	queries, err := NewQueries(path)
+	require.Nil(t, err)
+	query := queries.Get()["cities"]
+	assert.Equal(t, []Location{
+		{Name: "Madrid", Radius: 10},
+		{Latitude: 41.38, Longitude: 2.17, Radius: 5},
+	}, query.locations())
+	single := Query{LocationName: "Barcelona", LocationRadius: 5}
+	assert.Equal(t, []Location{{Name: "Barcelona", Radius: 5}}, single.locations())
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[cities]
+keywords = ["kindle"]
+
+[[cities.locations]]
+radius = 10
+
+[[cities.locations]]
+name = "Madrid"
+`), 0644))
+	_, err = NewQueries(path)
+	require.Error(t, err)
+	assert.Equal(t, `invalid queries: query "cities": location 1 has no name nor coordinates, `+
+		`location 2 radius must be positive`, err.Error())
+}
+
+func TestSearchDistance(t *testing.T) {
+	assert.Equal(t, float32(5000), (&Query{}).searchDistance(5))
+	assert.Equal(t, float32(5000), (&Query{RadiusUnit: "km"}).searchDistance(5))
+	assert.Equal(t, float32(500), (&Query{RadiusUnit: "m"}).searchDistance(500))
+}
+
+func TestSearchAge(t *testing.T) {
+	assert.Equal(t, DefaultSearchAge, (&Query{}).searchAge())
+	assert.Equal(t, 3*24*time.Hour, (&Query{MaxAgeDays: 3}).searchAge())
+}
+
+func TestLoadFormats(t *testing.T) {
+	expected := map[string]Query{
+		"iphone": {
+			Keywords:       []string{"iphone 7"},
+			Ignores:        []string{"ipad"},
+			LocationName:   "Barcelona",
+			LocationRadius: 5,
+			MaxPrice:       200,
+		},
+	}
+	files := map[string]string{
+		"queries.yaml": `
+iphone:
+  keywords: ["iphone 7"]
+  ignores: ["iPad"]
+  location_name: Barcelona
+  location_radius: 5
+  max_price: 200
+`,
+		"queries.json": `{"iphone": {"keywords": ["iphone 7"], "ignores": ["iPad"],
+"location_name": "Barcelona", "location_radius": 5, "max_price": 200}}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(t.TempDir(), name)
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		queries, err := NewQueries(path)
+		require.Nil(t, err, name)
+		assert.Equal(t, expected, queries.Get(), name)
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	object := SearchObject{Title: "iPhone 7 32GB", Description: "Con funda del iPad"}
+	assert.True(t, object.IsIgnored([]string{"ipad"}))
+	assert.True(t, object.IsIgnored([]string{"samsung", "32gb"}))
+	assert.False(t, object.IsIgnored([]string{"samsung"}))
+	assert.False(t, object.IsIgnored([]string{""}))
+	assert.False(t, object.IsIgnored(nil))
+}
+
+// objectIDs returns the IDs of objs.
+func objectIDs(objs []SearchObject) []string {
+	ids := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		ids = append(ids, obj.ID)
+	}
+	return ids
+}
+
+func TestFilterItems(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", Title: "Kindle Paperwhite"},
+		{ID: "2", Title: "Kindle", Description: "Funda incluida"},
+		{ID: "1", Title: "Kindle Paperwhite"},
+		{ID: "3", Title: "Kindle Oasis"},
+	}
+	tests := []struct {
+		name    string
+		ignores []string
+		ids     []string
+	}{
+		{name: "dedup", ignores: nil, ids: []string{"1", "2", "3"}},
+		{name: "ignore title", ignores: []string{"oasis"}, ids: []string{"1", "2"}},
+		{name: "ignore description", ignores: []string{"funda"}, ids: []string{"1", "3"}},
+		{name: "ignore all", ignores: []string{"kindle"}, ids: []string{}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ids, objectIDs(filterItems(objects, &Query{Ignores: test.ignores})), test.name)
+	}
+}
+
+func TestFeedAuthorAndLink(t *testing.T) {
+	feed, err := NewFeeds(&Queries{}, FeedsConfig{}).itemsFeed(context.Background(), &Query{}, nil)
+	require.Nil(t, err)
+	assert.Equal(t, DefaultFeedLink, feed.Link.Href)
+	assert.Equal(t, &gfeeds.Author{Name: DefaultFeedAuthorName, Email: DefaultFeedAuthorEmail}, feed.Author)
+
+	feed, err = NewFeeds(&Queries{}, FeedsConfig{
+		FeedAuthorName:  "Me",
+		FeedAuthorEmail: "me@example.com",
+		FeedLink:        "https://rss.example.com",
+	}).itemsFeed(context.Background(), &Query{}, nil)
+	require.Nil(t, err)
+	assert.Equal(t, "https://rss.example.com", feed.Link.Href)
+	assert.Equal(t, &gfeeds.Author{Name: "Me", Email: "me@example.com"}, feed.Author)
+}
+
+func TestItemsFeedConcurrency(t *testing.T) {
+	var objects []SearchObject
+	for i := 0; i < 20; i++ {
+		objects = append(objects, SearchObject{ID: strconv.Itoa(i), Title: "item " + strconv.Itoa(i)})
+	}
+	var m sync.Mutex
+	inFlight, maxInFlight, fetched := 0, 0, 0
+	client := &fakeClient{itemConcurrency: 3, getItem: func(ctx context.Context, itemID string) (*ResItem, error) {
+		m.Lock()
+		fetched++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		m.Unlock()
+		time.Sleep(time.Millisecond)
+		m.Lock()
+		inFlight--
+		m.Unlock()
+		if itemID == "failing" {
+			return nil, errors.New("item failed")
+		}
+		return &ResItem{ID: itemID}, nil
+	}}
+	f := NewFeeds(&Queries{}, FeedsConfig{Client: client, CacheTimeout: time.Hour})
+	feed, err := f.itemsFeed(context.Background(), &Query{}, append(objects, objects[0]))
+	require.Nil(t, err)
+	assert.LessOrEqual(t, maxInFlight, 3)
+	assert.Greater(t, maxInFlight, 1)
+	assert.Equal(t, len(objects), fetched)
+	require.Len(t, feed.Items, len(objects)+1)
+	for i, item := range feed.Items[:len(objects)] {
+		assert.Equal(t, objects[i].ID, item.Id)
+	}
+
+	// The cached items aren't fetched again.
+	_, err = f.itemsFeed(context.Background(), &Query{}, objects)
+	require.Nil(t, err)
+	assert.Equal(t, len(objects), fetched)
+
+	objects = append(objects, SearchObject{ID: "failing"})
+	_, err = f.itemsFeed(context.Background(), &Query{}, objects)
+	assert.EqualError(t, err, "item failed")
+}
+
+func TestItemsFeedMissingItem(t *testing.T) {
+	objects := []SearchObject{{ID: "1"}, {ID: "removed"}, {ID: "2"}, {ID: "3"}}
+	calls := make(map[string]int)
+	var m sync.Mutex
+	failing := ""
+	client := &fakeClient{getItem: func(ctx context.Context, itemID string) (*ResItem, error) {
+		m.Lock()
+		defer m.Unlock()
+		calls[itemID]++
+		switch itemID {
+		case "removed":
+			return nil, &HTTPError{StatusCode: http.StatusNotFound}
+		case failing:
+			return nil, errors.New("item failed")
+		}
+		return &ResItem{ID: itemID}, nil
+	}}
+	f := NewFeeds(&Queries{}, FeedsConfig{Client: client, CacheTimeout: time.Hour})
+
+	// The items fetched are cached even if another one fails.
+	failing = "3"
+	_, err := f.itemsFeed(context.Background(), &Query{}, objects)
+	assert.EqualError(t, err, "item failed")
+	failing = ""
+
+	for i := 0; i < 3; i++ {
+		feed, err := f.itemsFeed(context.Background(), &Query{}, objects)
+		require.Nil(t, err)
+		var ids []string
+		for _, item := range feed.Items {
+			ids = append(ids, item.Id)
+		}
+		assert.Equal(t, []string{"1", "2", "3"}, ids)
+	}
+	// The removed item is requested again after the failed update, which
+	// can't tell it from the items not fetched, but not on every update.
+	assert.Equal(t, map[string]int{"1": 1, "removed": 2, "2": 1, "3": 2}, calls)
+}
+
+func BenchmarkItemsFeed(b *testing.B) {
+	var objects []SearchObject
+	for i := 0; i < 100; i++ {
+		objects = append(objects, SearchObject{ID: strconv.Itoa(i)})
+	}
+	for _, concurrency := range []int{1, DefaultItemConcurrency, 16} {
+		client := &fakeClient{itemConcurrency: concurrency, getItem: func(ctx context.Context, itemID string) (*ResItem, error) {
+			// The latency of a request to the API.
+			time.Sleep(time.Millisecond)
+			return &ResItem{ID: itemID}, nil
+		}}
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// No expiration, so that every item is fetched.
+				f := NewFeeds(&Queries{}, FeedsConfig{Client: client})
+				if _, err := f.itemsFeed(context.Background(), &Query{}, objects); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFeedRSS(t *testing.T) {
+	var res ResSearch
+	require.Nil(t, json.Unmarshal([]byte(`{"search_objects": [
+		{"id": "1", "title": "Kindle", "description": "Like new", "price": 40, "currency": "EUR",
+		 "web_slug": "kindle-1", "user": {"micro_name": "Ana"}},
+		{"id": "2", "title": "PS Vita", "description": "", "price": 90.5, "currency": "EUR",
+		 "web_slug": "ps-vita-2", "images": [{"original": "https://cdn.wallapop.com/2.jpg"}]}
+	]}`), &res))
+	items := map[string]*ResItem{
+		"1": {ID: "1", ModifiedDate: 1614600000, Images: []ItemImage{
+			{URLs: struct {
+				Big string `json:"big"`
+			}{Big: "https://cdn.wallapop.com/images/1.jpg?pictureSize=W800"}},
+		}},
+		"2": {ID: "2", ModifiedDate: 1614500000},
+	}
+	query := &Query{Keywords: []string{"kindle"}}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	rss, err := NewFeeds(&Queries{}, FeedsConfig{}).buildFeed(query, res.SearchObjects, items, now).ToRss()
+	require.Nil(t, err)
+
+	type rssItem struct {
+		GUID    string `xml:"guid"`
+		Title   string `xml:"title"`
+		Link    string `xml:"link"`
+		PubDate string `xml:"pubDate"`
+	}
+	var parsed struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel struct {
+			Title       string    `xml:"title"`
+			Link        string    `xml:"link"`
+			Description string    `xml:"description"`
+			Items       []rssItem `xml:"item"`
+		} `xml:"channel"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(rss), &parsed))
+	assert.Equal(t, "2.0", parsed.Version)
+	assert.Equal(t, "[kindle] - Wallapop RSS v2", parsed.Channel.Title)
+	assert.Equal(t, DefaultFeedLink, parsed.Channel.Link)
+	assert.NotEmpty(t, parsed.Channel.Description)
+	require.Len(t, parsed.Channel.Items, 2)
+	for i, expected := range []struct {
+		rssItem
+		date int64
+	}{
+		{rssItem{GUID: "1", Title: "Kindle - 40 EUR", Link: URL + "/item/kindle-1"}, 1614600000},
+		{rssItem{GUID: "2", Title: "PS Vita - 90.5 EUR", Link: URL + "/item/ps-vita-2"}, 1614500000},
+	} {
+		item := parsed.Channel.Items[i]
+		assert.Equal(t, expected.GUID, item.GUID)
+		assert.Equal(t, expected.Title, item.Title)
+		assert.Equal(t, expected.Link, item.Link)
+		pubDate, err := time.Parse(time.RFC1123Z, item.PubDate)
+		require.Nil(t, err, item.GUID)
+		assert.Equal(t, expected.date, pubDate.Unix())
+	}
+	assert.Contains(t, rss, `https://cdn.wallapop.com/images/1.jpg?pictureSize=W1024`)
+	assert.Contains(t, rss, `https://cdn.wallapop.com/2.jpg`)
+}
+
+func TestBuildFeedRSSEscaped(t *testing.T) {
+	objects := []SearchObject{{ID: "1", Title: "Nintendo & Sega <lote>", Description: "Mega Drive & <b>SNES</b>",
+		Price: 50, Currency: "EUR", WebSlug: "lote-1", User: User{MicroName: "Ana & Co"}}}
+	items := map[string]*ResItem{"1": {ID: "1"}}
+	query := &Query{Keywords: []string{"nintendo & sega"}}
+	rss, err := NewFeeds(&Queries{}, FeedsConfig{}).buildFeed(query, objects, items, time.Now()).ToRss()
+	require.Nil(t, err)
+
+	var parsed struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title       string `xml:"title"`
+				Description string `xml:"description"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(rss), &parsed))
+	assert.Equal(t, "[nintendo & sega] - Wallapop RSS v2", parsed.Channel.Title)
+	require.Len(t, parsed.Channel.Items, 1)
+	assert.Equal(t, "Nintendo & Sega <lote> - 50 EUR", parsed.Channel.Items[0].Title)
+	assert.Equal(t, "Mega Drive &amp; &lt;b&gt;SNES&lt;/b&gt;<br/>", parsed.Channel.Items[0].Description)
+}
+
+func TestItemTitle(t *testing.T) {
+	item := SearchObject{Title: "Kindle", Price: 40, Currency: "EUR"}
+	mark := &Query{MarkStatus: true}
+	assert.Equal(t, "Kindle - 40 EUR", itemTitle(&item, mark))
+	item.Flags.Reserved = true
+	assert.Equal(t, "[RESERVED] Kindle - 40 EUR", itemTitle(&item, mark))
+	item.Flags.Sold = true
+	assert.Equal(t, "[SOLD] Kindle - 40 EUR", itemTitle(&item, mark))
+	assert.Equal(t, "Kindle - 40 EUR", itemTitle(&item, &Query{}))
+}
+
+func TestImageURL(t *testing.T) {
+	big := "https://cdn.wallapop.com/images/i1.jpg?pictureSize=W800"
+	assert.Equal(t, "https://cdn.wallapop.com/images/i1.jpg?pictureSize=W1024",
+		imageURL(big, "800", "1024"))
+	assert.Equal(t, "https://cdn.wallapop.com/images/i1.jpg?pictureSize=W640",
+		imageURL(big, "800", "640"))
+	assert.Equal(t, "https://cdn.wallapop.com/images/i1.jpg?size=large",
+		imageURL("https://cdn.wallapop.com/images/i1.jpg?size=medium", "medium", "large"))
+	for _, other := range []string{
+		"https://cdn.wallapop.com/images/i1.jpg?pictureSize=W320",
+		"https://cdn.wallapop.com/images/i1.jpg?pictureSize=W1800",
+		"https://cdn.wallapop.com/images/i1.jpg",
+	} {
+		assert.Equal(t, other, imageURL(other, "800", "1024"))
+	}
+}
+
+func TestImageSuffixes(t *testing.T) {
+	for _, tc := range []struct {
+		query    Query
+		from, to string
+	}{
+		{Query{}, "800", "1024"},
+		{Query{ImageSize: 640}, "800", "640"},
+		{Query{ImageFrom: "W800", ImageTo: "W1600"}, "W800", "W1600"},
+	} {
+		from, to := tc.query.imageSuffixes()
+		assert.Equal(t, tc.from, from)
+		assert.Equal(t, tc.to, to)
+	}
+	query := Query{Keywords: []string{"kindle"}, LocationName: "Barcelona", LocationRadius: 5,
+		ImageSize: 640, ImageTo: "W1600"}
+	assert.EqualError(t, query.Validate(), "image_size can't be combined with image_to")
+}
+
+func TestItemImages(t *testing.T) {
+	item := SearchObject{Images: []Image{{Original: "https://cdn/s1.jpg"}, {Original: "https://cdn/s2.jpg"}}}
+	itemData := ResItem{Images: make([]ItemImage, 3)}
+	for i := range itemData.Images {
+		itemData.Images[i].URLs.Big = fmt.Sprintf("https://cdn/i%v.jpg?pictureSize=W800", i)
+	}
+
+	assert.Equal(t, []string{
+		"https://cdn/i0.jpg?pictureSize=W1024",
+		"https://cdn/i1.jpg?pictureSize=W1024",
+	}, itemImages(&item, &itemData, &Query{MaxImages: 2}))
+	assert.Len(t, itemImages(&item, &itemData, &Query{}), 3)
+	assert.Equal(t, []string{"https://cdn/s1.jpg", "https://cdn/s2.jpg"},
+		itemImages(&item, &ResItem{}, &Query{}))
+}
+
+func TestItemDescription(t *testing.T) {
+	item := SearchObject{Description: strings.Repeat("Muy buen estado ", 100)}
+	images := []string{"https://cdn/i0.jpg?pictureSize=W1024", "https://cdn/i1.jpg?pictureSize=W1024"}
+	imagesHTML := `<br/><img src="https://cdn/i0.jpg?pictureSize=W1024"><br/>` +
+		`<img src="https://cdn/i1.jpg?pictureSize=W1024"><br/>`
+
+	assert.Equal(t, "Muy buen estado Muy…"+imagesHTML,
+		itemDescription(&item, images, &Query{MaxDescriptionChars: 20}))
+	assert.Equal(t, item.Description+imagesHTML, itemDescription(&item, images, &Query{}))
+	item.Description = "Cámara"
+	assert.Equal(t, "Cámara"+imagesHTML, itemDescription(&item, images, &Query{MaxDescriptionChars: 6}))
+	assert.Equal(t, "Cám…"+imagesHTML, itemDescription(&item, images, &Query{MaxDescriptionChars: 4}))
+	assert.Equal(t, "Cámara<br/>", itemDescription(&item, nil, &Query{}))
+}
+
+func TestItemDescriptionEscaped(t *testing.T) {
+	item := SearchObject{Description: `Funda & cargador <script>alert("x")</script>`}
+	assert.Equal(t, "Funda &amp; cargador &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;<br/>"+
+		`<img src="https://cdn/s1.jpg?a=1&amp;b=&#34;2&#34;"><br/>`,
+		itemDescription(&item, []string{`https://cdn/s1.jpg?a=1&b="2"`}, &Query{}))
+}
+
+func TestIncludeImages(t *testing.T) {
+	objects := []SearchObject{{ID: "1", Title: "Kindle", Price: 40, Currency: "EUR", WebSlug: "kindle-1",
+		Description: "Like new", Images: []Image{{Original: "https://cdn/1.jpg"}}}}
+	items := map[string]*ResItem{"1": {ID: "1"}}
+	include, exclude := true, false
+	for _, tc := range []struct {
+		cfg    FeedsConfig
+		query  Query
+		images bool
+	}{
+		{FeedsConfig{}, Query{}, true},
+		{FeedsConfig{}, Query{IncludeImages: &exclude}, false},
+		{FeedsConfig{NoImages: true}, Query{}, false},
+		{FeedsConfig{NoImages: true}, Query{IncludeImages: &include}, true},
+	} {
+		tc.query.MediaThumbnails = true
+		feed := NewFeeds(&Queries{}, tc.cfg).buildFeed(&tc.query, objects, items, time.Now())
+		require.Len(t, feed.Items, 1)
+		item := feed.Items[0]
+		assert.Equal(t, "Kindle - 40 EUR", item.Title)
+		assert.Equal(t, URL+"/item/kindle-1", item.Link.Href)
+		if tc.images {
+			assert.Contains(t, item.Description, "<img")
+			assert.NotNil(t, item.Enclosure)
+		} else {
+			assert.Equal(t, "Like new<br/>", item.Description)
+			assert.Nil(t, item.Enclosure)
+		}
+	}
+}
+
+func TestFilterItemsAcrossKeywords(t *testing.T) {
+	// Results of the keywords "ps vita" and "psvita".
+	psVita := []SearchObject{
+		{ID: "1", Title: "PS Vita", WebSlug: "ps-vita-1"},
+		{ID: "2", Title: "PS Vita Slim", WebSlug: "ps-vita-slim-2"},
+	}
+	psvita := []SearchObject{
+		{ID: "3", Title: "PSVita juegos", WebSlug: "psvita-juegos-3"},
+		{ID: "1", Title: "PS Vita", WebSlug: "ps-vita-consola-1"},
+	}
+	kept := filterItems(append(append([]SearchObject{}, psVita...), psvita...), &Query{})
+	require.Len(t, kept, 3)
+	assert.Equal(t, psVita[0], kept[0])
+	assert.Equal(t, psVita[1], kept[1])
+	assert.Equal(t, psvita[0], kept[2])
+}
+
+func TestFilterItemsMaxDistance(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", Distance: 0.5},
+		{ID: "2", Distance: 4.9},
+		{ID: "3", Distance: 5},
+		{ID: "4", Distance: 5.1},
+		{ID: "5", Distance: 12},
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, objectIDs(filterItems(objects, &Query{MaxDistanceKm: 5})))
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, objectIDs(filterItems(objects, &Query{})))
+}
+
+func TestFilterItemsPriceRange(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", Price: 0},
+		{ID: "2", Price: 49.99},
+		{ID: "3", Price: 100},
+		{ID: "4", Price: 100.5},
+		{ID: "5", Price: 15000},
+	}
+	assert.Equal(t, []string{"2", "3"}, objectIDs(filterItems(objects, &Query{MinPrice: 10, MaxPrice: 100})))
+	// An unset max_price doesn't cap expensive items.
+	assert.Equal(t, []string{"3", "4", "5"}, objectIDs(filterItems(objects, &Query{MinPrice: 100})))
+	assert.Len(t, filterItems(objects, &Query{}), 5)
+}
+
+func TestFilterItemsCurrency(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", Currency: "EUR"},
+		{ID: "2", Currency: "GBP"},
+		{ID: "3", Currency: "eur"},
+	}
+	assert.Equal(t, []SearchObject{objects[0], objects[2]}, filterItems(objects, &Query{Currency: "EUR"}))
+	assert.Len(t, filterItems(objects, &Query{}), 3)
+	assert.True(t, validCurrency("gbp"))
+	assert.False(t, validCurrency("€"))
+	assert.False(t, validCurrency("EURO"))
+}
+
+func TestFilterItemsShipping(t *testing.T) {
+	var objects []SearchObject
+	require.Nil(t, json.Unmarshal([]byte(`[
+		{"id": "1", "shipping": {"item_is_shippable": true, "user_allows_shipping": true}},
+		{"id": "2", "shipping": {"item_is_shippable": true, "user_allows_shipping": false}},
+		{"id": "3", "shipping": {"item_is_shippable": false, "user_allows_shipping": true}},
+		{"id": "4"}
+	]`), &objects))
+	assert.Equal(t, []SearchObject{objects[0], objects[3]}, filterItems(objects, &Query{ShippingOnly: true}))
+	assert.Len(t, filterItems(objects, &Query{}), 4)
+}
+
+func TestFilterItemsCategories(t *testing.T) {
+	objects := []SearchObject{{ID: "1", CategoryID: 12579}, {ID: "2", CategoryID: 12902}, {ID: "3"}}
+	query := Query{CategoryIDs: []int{12579, 100}}
+	assert.Equal(t, []SearchObject{objects[0], objects[2]}, filterItems(objects, &query))
+	assert.Len(t, filterItems(objects, &Query{}), 3)
+	assert.Equal(t, "12579,100", query.categoryIDs())
+	assert.Equal(t, "", (&Query{}).categoryIDs())
+	assert.Equal(t, "Like new<br/>Category: 12579<br/>",
+		itemDescription(&SearchObject{Description: "Like new", CategoryID: 12579}, nil, &query))
+}
+
+func TestFilterItemsSellers(t *testing.T) {
+	objects := []SearchObject{
+		{ID: "1", User: User{ID: "u1", MicroName: "Reseller"}},
+		{ID: "2", User: User{ID: "u2", MicroName: "Ana"}},
+		{ID: "3", User: User{ID: "u3", MicroName: "Pau"}},
+	}
+	assert.Equal(t, []string{"2"}, objectIDs(filterItems(objects, &Query{IgnoreSellers: []string{"reseller", "u3"}})))
+	// User IDs are matched exactly.
+	assert.Equal(t, []string{"1", "2", "3"}, objectIDs(filterItems(objects, &Query{IgnoreSellers: []string{"U3"}})))
+	assert.Equal(t, []string{"2", "3"}, objectIDs(filterItems(objects, &Query{OnlySellers: []string{"ANA", "u3"}})))
+	assert.Equal(t, []string{"3"}, objectIDs(filterItems(objects,
+		&Query{OnlySellers: []string{"ana", "u3"}, IgnoreSellers: []string{"u2"}})))
+}
+
+func TestNextCursor(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := nextCursor(nil, &ResSearch{
+		SearchObjects:  []SearchObject{{ID: "2", Price: 10}, {ID: "1"}},
+		PaginationDate: start.Add(-time.Hour),
+	}, start, start.Add(-48*time.Hour))
+	assert.Equal(t, start.Add(-time.Hour), first.PaginationDate)
+	assert.Equal(t, []SearchObject{{ID: "2", Price: 10}, {ID: "1"}}, first.Objects)
+
+	// The new page has a new item and an updated one, the rest are kept.
+	now := start.Add(time.Hour)
+	second := nextCursor(first, &ResSearch{
+		SearchObjects:  []SearchObject{{ID: "3"}, {ID: "2", Price: 8}},
+		PaginationDate: start,
+	}, now, now.Add(-48*time.Hour))
+	assert.Equal(t, start, second.PaginationDate)
+	assert.Equal(t, []SearchObject{{ID: "3"}, {ID: "2", Price: 8}, {ID: "1"}}, second.Objects)
+
+	// The items found before the limit are dropped unless present in the
+	// new page.
+	third := nextCursor(second, &ResSearch{
+		SearchObjects:  []SearchObject{{ID: "2", Price: 8}},
+		PaginationDate: start,
+	}, now, start.Add(time.Minute))
+	assert.Equal(t, []SearchObject{{ID: "2", Price: 8}, {ID: "3"}}, third.Objects)
+	assert.Equal(t, start, third.found["2"])
+}
+
+func TestIncrementalSearchRemoved(t *testing.T) {
+	for _, query := range []Query{
+		{Keywords: []string{"kindle"}, Latitude: 41.38804, Longitude: 2.17001},
+		{Keywords: []string{"kindle"}, Latitude: 41.38804, Longitude: 2.17001, MaxPrice: 50},
+	} {
+		queries := Queries{queries: map[string]Query{"kindle": query}}
+		paginationDate := time.Now().Truncate(time.Second)
+		searches := 0
+		calls := make(map[string]int)
+		client := &fakeClient{
+			search: func(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+				searches++
+				if searches > 1 {
+					// Resumed from the previous search, no new listings.
+					assert.Equal(t, paginationDate, opts.Since)
+					return &ResSearch{PaginationDate: paginationDate}, nil
+				}
+				assert.True(t, opts.Since.IsZero())
+				return &ResSearch{
+					SearchObjects:  []SearchObject{{ID: "1"}, {ID: "2"}},
+					PaginationDate: paginationDate,
+				}, nil
+			},
+			getItem: func(ctx context.Context, itemID string) (*ResItem, error) {
+				calls[itemID]++
+				if itemID == "2" && searches > 1 {
+					return nil, &HTTPError{StatusCode: http.StatusNotFound}
+				}
+				return &ResItem{ID: itemID}, nil
+			},
+		}
+		// The items expire right away.
+		feeds := NewFeeds(&queries, FeedsConfig{Client: client, IncrementalSearch: true})
+		feeds.Update(context.Background())
+		feed, err := feeds.Get("kindle")
+		require.Nil(t, err)
+		assert.Len(t, feed.Items, 2)
+
+		// Removed upstream, the retained listing is dropped once.
+		for i := 0; i < 3; i++ {
+			feeds.Update(context.Background())
+			status := feeds.Status()
+			require.Len(t, status, 1)
+			assert.Empty(t, status[0].LastError)
+			feed, err := feeds.Get("kindle")
+			require.Nil(t, err)
+			require.Len(t, feed.Items, 1)
+			assert.Equal(t, "1", feed.Items[0].Id)
+		}
+		assert.Equal(t, map[string]int{"1": 4, "2": 2}, calls)
+
+		// Every update resumes the same search.
+		require.Len(t, feeds.cursors, 1)
+		assert.Len(t, feeds.cursors["kindle"], 1)
+
+		// The incremental searches of the removed queries are dropped.
+		queries.set(map[string]Query{})
+		feeds.Update(context.Background())
+		assert.Empty(t, feeds.cursors)
+	}
+}
+
+func TestSearchFeedTimeout(t *testing.T) {
+	client := &fakeClient{search: func(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+		assert.NotNil(t, ctx.Value(onDemandKey{}))
+		return &ResSearch{}, nil
+	}}
+	feeds := NewFeeds(&Queries{}, FeedsConfig{Client: client, UpdateTimeout: time.Minute})
+	_, err := feeds.SearchFeed(context.Background(),
+		&Query{Keywords: []string{"kindle"}, Latitude: 41.38804, Longitude: 2.17001})
+	require.Nil(t, err)
+}
+
+func TestGetParamsStringHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	}))
+	defer srv.Close()
+
+	var res struct{}
+	_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+	var httpErr *HTTPError
+	require.True(t, errors.As(err, &httpErr))
+	assert.Equal(t, http.StatusInternalServerError, httpErr.StatusCode)
+	assert.Equal(t, "boom", httpErr.Body)
+}
+
+func TestGetParamsStringNotJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html>challenge</html>"))
+	}))
+	defer srv.Close()
+
+	var res struct{}
+	_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+	require.Error(t, err)
+	assert.Equal(t, `expected JSON, got text/html; charset=utf-8: "<html>challenge</html>"`, err.Error())
+}
+
+func TestGetParamsStringBotChallenge(t *testing.T) {
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+	for _, tc := range []struct {
+		status      int
+		contentType string
+		body        string
+		challenge   bool
+	}{
+		{403, "text/html", "<html>forbidden</html>", true},
+		{503, "text/html; charset=UTF-8", "<html><head><title>Attention Required! | Cloudflare</title>", true},
+		{200, "text/html", "<title>Just a moment...</title>", true},
+		{200, "text/html", "<title>Wallapop</title>", false},
+		{403, "application/json", `{"error": "forbidden"}`, false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+		var res struct{}
+		_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+		srv.Close()
+		require.Error(t, err, tc.body)
+		assert.Equal(t, tc.challenge, errors.Is(err, ErrBotChallenge), tc.body)
+	}
+}
+
+func TestGetParamsStringTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxResponseSize+1))
+	}))
+	defer srv.Close()
+
+	var res struct{}
+	_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than")
+}
+
+func TestCookies(t *testing.T) {
+	var cookies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	defer SetCookies(true)
+
+	var res struct{}
+	for _, enabled := range []bool{true, false} {
+		SetCookies(enabled)
+		cookies = nil
+		for i := 0; i < 2; i++ {
+			_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+			require.Nil(t, err)
+		}
+		if enabled {
+			assert.Equal(t, []string{"", "session=abc"}, cookies)
+		} else {
+			assert.Equal(t, []string{"", ""}, cookies)
+		}
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("{}"))
+	}))
+	defer proxy.Close()
+	require.Nil(t, SetProxy(proxy.URL))
+	defer SetProxy("")
+
+	var res struct{}
+	_, err := GetParamsString(context.Background(), "http://api.wallapop.invalid/search", "a=1", &res)
+	require.Nil(t, err)
+	assert.Equal(t, "http://api.wallapop.invalid/search?a=1", proxied)
+
+	assert.Error(t, SetProxy("ftp://proxy"))
+	assert.Error(t, SetProxy("://proxy"))
+}
+
+func TestGetParamsStringTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	SetHTTPTimeout(50 * time.Millisecond)
+	defer SetHTTPTimeout(DefaultHTTPTimeout)
+
+	var res struct{}
+	start := time.Now()
+	_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestGetParamsStringRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	SetRateLimit(10)
+	defer SetRateLimit(DefaultRateLimit)
+
+	var res struct{}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := GetParamsString(context.Background(), srv.URL, "", &res)
+		require.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+}
+
+func TestSearchPagination(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	next := now.Add(-time.Hour).Format(time.RFC3339)
+	var requests []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/general/search", r.URL.Path)
+		requests = append(requests, r.URL.Query())
+		if len(requests) == 1 {
+			w.Header().Set("X-NextPage", "step=1&search_id=abc&pagination_date="+next)
+			w.Write([]byte(`{"search_objects": [{"id": "1"}, {"id": "2"}]}`))
+			return
+		}
+		old := now.Add(-30 * 24 * time.Hour).Format(time.RFC3339)
+		w.Header().Set("X-NextPage", "step=2&search_id=abc&pagination_date="+old)
+		w.Write([]byte(`{"search_objects": [{"id": "3"}]}`))
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+	defer func() { apiURL = URLAPIV3 }()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+
+	res, err := Search(context.Background(), SearchOpts{Age: 24 * time.Hour},
+		&ReqSearch{Keywords: "kindle", OrderBy: "newest"})
+	require.Nil(t, err)
+	assert.Equal(t, []SearchObject{{ID: "1"}, {ID: "2"}, {ID: "3"}}, res.SearchObjects)
+	assert.Equal(t, now.Add(-time.Hour), res.PaginationDate.UTC())
+
+	require.Len(t, requests, 2)
+	for _, field := range []string{"step", "search_id", "pagination_date"} {
+		assert.Empty(t, requests[0].Get(field), field)
+	}
+	assert.Equal(t, "kindle", requests[1].Get("keywords"))
+	assert.Equal(t, "1", requests[1].Get("step"))
+	assert.Equal(t, "abc", requests[1].Get("search_id"))
+	assert.Equal(t, next, requests[1].Get("pagination_date"))
+}
+
+func TestSearchLastPage(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			next := time.Now().Add(-time.Hour).Format(time.RFC3339)
+			w.Header().Set("X-NextPage", "step=1&search_id=abc&pagination_date="+next)
+			w.Write([]byte(`{"search_objects": [{"id": "1"}]}`))
+			return
+		}
+		w.Write([]byte(`{"search_objects": [{"id": "2"}]}`))
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+	defer func() { apiURL = URLAPIV3 }()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+
+	res, err := Search(context.Background(), SearchOpts{}, &ReqSearch{Keywords: "kindle"})
+	require.Nil(t, err)
+	assert.Equal(t, []SearchObject{{ID: "1"}, {ID: "2"}}, res.SearchObjects)
+	assert.Equal(t, 2, requests)
+}
+
+func TestSearchFirstPageOnly(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		next := time.Now().Add(-time.Hour).Format(time.RFC3339)
+		w.Header().Set("X-NextPage", "step=1&search_id=abc&pagination_date="+next)
+		w.Write([]byte(`{"search_objects": [{"id": "1"}]}`))
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+	defer func() { apiURL = URLAPIV3 }()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+
+	opts := (&Query{FirstPageOnly: true}).searchOpts()
+	assert.Equal(t, SearchOpts{Age: DefaultSearchAge, FirstPageOnly: true}, opts)
+	res, err := Search(context.Background(), opts, &ReqSearch{Keywords: "kindle"})
+	require.Nil(t, err)
+	assert.Equal(t, []SearchObject{{ID: "1"}}, res.SearchObjects)
+	assert.False(t, res.PaginationDate.IsZero())
+	assert.Equal(t, 1, requests)
+}
+
+func TestDebugSearch(t *testing.T) {
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/general/search", r.URL.Path)
+		assert.NotEmpty(t, r.Header.Get("X-Signature"))
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<html>denied</html>"))
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+	defer func() { apiURL = URLAPIV3 }()
+	SetRateLimit(0)
+	defer SetRateLimit(DefaultRateLimit)
+
+	feeds := NewFeeds(&Queries{}, FeedsConfig{})
+	res, err := feeds.DebugSearch(context.Background(), &Query{Keywords: []string{"kindle", "ipad"},
+		Latitude: 41.38, Longitude: 2.17, LocationRadius: 5})
+	require.Nil(t, err)
+	assert.Equal(t, "kindle", query.Get("keywords"))
+	assert.Equal(t, "5000", query.Get("distance"))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.Equal(t, "text/html", res.Headers["Content-Type"])
+	assert.Equal(t, "<html>denied</html>", res.BodyText)
+	assert.Nil(t, res.Body)
+	assert.Equal(t, srv.URL+"/general/search?"+query.Encode(), res.URL)
+	assert.NotEmpty(t, res.RequestHeaders["X-Signature"])
+	assert.NotContains(t, fmt.Sprint(res.RequestHeaders), string(KEY))
+}
+
+// fakeClient is a Client that answers with its functions.
+type fakeClient struct {
+	search       func(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error)
+	getItem      func(ctx context.Context, itemID string) (*ResItem, error)
+	getLocation  func(ctx context.Context, place string) (*ResMapsHerePlace, error)
+	getUserStats func(ctx context.Context, userID string) (*ResUserStats, error)
+	// itemConcurrency is the concurrency of GetItems.
+	itemConcurrency int
+}
+
+func (c *fakeClient) Search(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+	return c.search(ctx, opts, req)
+}
+
+func (c *fakeClient) GetItem(ctx context.Context, itemID string) (*ResItem, error) {
+	return c.getItem(ctx, itemID)
+}
+
+func (c *fakeClient) GetItems(ctx context.Context, itemIDs []string) ([]*ResItem, error) {
+	return getItemsWith(ctx, itemIDs, c.itemConcurrency, c.getItem)
+}
+
+func (c *fakeClient) GetLocation(ctx context.Context, place string) (*ResMapsHerePlace, error) {
+	return c.getLocation(ctx, place)
+}
+
+func (c *fakeClient) GetUserStats(ctx context.Context, userID string) (*ResUserStats, error) {
+	return c.getUserStats(ctx, userID)
+}
+
+func TestFilterSellerRating(t *testing.T) {
+	var stats ResUserStats
+	require.Nil(t, json.Unmarshal([]byte(`{"ratings": [{"type": "reviews", "value": 90}],
+		"counters": [{"type": "publish", "value": 30}, {"type": "reviews", "value": 12}]}`), &stats))
+	rating, reviews := stats.Rating()
+	assert.Equal(t, float32(4.5), rating)
+	assert.Equal(t, 12, reviews)
+
+	three := float32(3)
+	objects := []SearchObject{
+		{ID: "1", User: User{ID: "good"}},
+		{ID: "2", User: User{ID: "bad"}},
+		{ID: "3", User: User{ID: "new"}},
+		{ID: "4", User: User{ID: "good"}},
+		{ID: "5", User: User{ID: "rated", Rating: &three, Reviews: 2}},
+	}
+	fetched := make(map[string]int)
+	client := &fakeClient{getUserStats: func(ctx context.Context, userID string) (*ResUserStats, error) {
+		fetched[userID]++
+		return map[string]*ResUserStats{
+			"good": &stats,
+			"bad":  {Ratings: []UserStat{{"reviews", 40}}, Counters: []UserStat{{"reviews", 3}}},
+			"new":  {},
+		}[userID], nil
+	}}
+	feeds := NewFeeds(&Queries{}, FeedsConfig{Client: client, CacheTimeout: time.Hour})
+	kept, err := feeds.filterSellerRating(context.Background(), &Query{MinSellerRating: 4}, objects)
+	require.Nil(t, err)
+	assert.Equal(t, []SearchObject{objects[0], objects[2], objects[3]}, kept)
+	assert.Equal(t, map[string]int{"good": 1, "bad": 1, "new": 1}, fetched)
+
+	kept, err = feeds.filterSellerRating(context.Background(), &Query{}, objects)
+	require.Nil(t, err)
+	assert.Equal(t, objects, kept)
+}
+
 func TestGenFeed(t *testing.T) {
 	query := Query{
-		Keywords:       []string{"psp"},
-		Ignores:        []string{},
+		Keywords:       []string{"psp", "psp go"},
+		Ignores:        []string{"roto"},
 		LocationName:   "Barcelona",
 		LocationRadius: 5,
 		MinPrice:       100,
@@ -22,13 +1189,353 @@ func TestGenFeed(t *testing.T) {
 		queries: map[string]Query{},
 	}
 	cfg := FeedsConfig{
-		CacheTimeout:     1 * time.Second,
-		UpdateQueryDelay: 60 * time.Minute,
+		CacheTimeout:      1 * time.Second,
+		UpdateConcurrency: 1,
 	}
+	var searched []string
+	maxPrice := 200
+	client := &fakeClient{}
+	client.getLocation = func(ctx context.Context, place string) (*ResMapsHerePlace, error) {
+		assert.Equal(t, "Barcelona", place)
+		return &ResMapsHerePlace{Latitude: 41.38804, Longitude: 2.17001}, nil
+	}
+	client.search = func(ctx context.Context, opts SearchOpts, req *ReqSearch) (*ResSearch, error) {
+		searched = append(searched, req.Keywords)
+		assert.Equal(t, DefaultSearchAge, opts.Age)
+		assert.Equal(t, ReqSearch{
+			Distance:      5000,
+			Keywords:      req.Keywords,
+			FiltersSource: "quick_filters",
+			OrderBy:       "newest",
+			MinSalePrice:  100,
+			MaxSalePrice:  &maxPrice,
+			Latitude:      41.38804,
+			Longitude:     2.17001,
+			Language:      DefaultLanguage,
+		}, *req)
+		return &ResSearch{SearchObjects: []SearchObject{
+			{ID: "1", Title: "PSP", Price: 120, Currency: "EUR", WebSlug: "psp-1",
+				User: User{MicroName: "Ana"}},
+			{ID: "2", Title: "PSP roto", Price: 150, Currency: "EUR", WebSlug: "psp-roto-2"},
+			{ID: "3", Title: "PSP Go", Price: 250, Currency: "EUR", WebSlug: "psp-go-3"},
+		}}, nil
+	}
+	client.getItem = func(ctx context.Context, itemID string) (*ResItem, error) {
+		return &ResItem{ID: itemID, ModifiedDate: 1614600000}, nil
+	}
+	cfg.Client = client
 	feeds := NewFeeds(&queries, cfg)
-	feed, err := feeds.genFeed(&query)
+	feed, err := feeds.genFeed(context.Background(), &query)
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{"psp", "psp go"}, searched)
+	require.Len(t, feed.Items, 1)
+	item := feed.Items[0]
+	assert.Equal(t, "1", item.Id)
+	assert.Equal(t, "PSP - 120 EUR", item.Title)
+	assert.Equal(t, URL+"/item/psp-1", item.Link.Href)
+	assert.Equal(t, "Ana", item.Author.Name)
+	assert.Equal(t, time.Unix(1614600000, 0), item.Created)
+}
+
+func TestUpdateConcurrency(t *testing.T) {
+	queries := Queries{queries: map[string]Query{}}
+	for i := 0; i < 10; i++ {
+		queries.queries[fmt.Sprintf("q%v", i)] = Query{}
+	}
+	feeds := NewFeeds(&queries, FeedsConfig{UpdateConcurrency: 3})
+	var m sync.Mutex
+	running, maxRunning := 0, 0
+	// full is closed once 3 updates run at the same time, which the first
+	// ones wait for.
+	full := make(chan struct{})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		m.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+			if maxRunning == 3 {
+				close(full)
+			}
+		}
+		m.Unlock()
+		select {
+		case <-full:
+		case <-time.After(time.Second):
+		}
+		m.Lock()
+		running--
+		m.Unlock()
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	assert.LessOrEqual(t, maxRunning, 3)
+	select {
+	case <-full:
+	default:
+		t.Error("the updates didn't reach the concurrency limit")
+	}
+	for name := range queries.queries {
+		_, err := feeds.Get(name)
+		assert.Nil(t, err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	cache := NewCache(func(ctx context.Context, key string) (interface{}, error) {
+		return key, nil
+	}, time.Hour)
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "a", "a"} {
+		_, err := cache.Get(ctx, key)
+		require.Nil(t, err)
+	}
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Size: 2}, cache.Stats())
+
+	cache.expiration = 0
+	cache.Clean()
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Size: 0, Evictions: 2}, cache.Stats())
+}
+
+func TestCacheGetExpired(t *testing.T) {
+	fetches := 0
+	cache := NewCache(func(ctx context.Context, key string) (interface{}, error) {
+		fetches++
+		return fetches, nil
+	}, time.Hour)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	value, err := cache.Get(ctx, "a")
+	require.Nil(t, err)
+	assert.Equal(t, 1, value)
+	now = now.Add(30 * time.Minute)
+	value, err = cache.Get(ctx, "a")
+	require.Nil(t, err)
+	assert.Equal(t, 1, value)
+
+	// The entry is expired even though Clean didn't run.
+	now = now.Add(time.Hour)
+	value, err = cache.Get(ctx, "a")
+	require.Nil(t, err)
+	assert.Equal(t, 2, value)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Size: 1}, cache.Stats())
+}
+
+func TestUpdateFeedPerQuery(t *testing.T) {
+	queries := Queries{queries: map[string]Query{}}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("q%v", i)
+		queries.queries[name] = Query{Keywords: []string{name}}
+	}
+	feeds := NewFeeds(&queries, FeedsConfig{UpdateConcurrency: 4})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Title: query.Keywords[0], Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	for name := range queries.queries {
+		feed, err := feeds.Get(name)
+		require.Nil(t, err, name)
+		assert.Equal(t, name, feed.Title)
+	}
+}
+
+func TestGetRSS(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"kindle": {}}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	title := "first"
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Title: title, Link: &gfeeds.Link{}}, nil
+	}
+	_, err := feeds.GetRSS("kindle")
+	assert.Equal(t, ErrFeedNotFound, err)
+
+	feeds.Update(context.Background())
+	rss, err := feeds.GetRSS("kindle")
+	require.Nil(t, err)
+	assert.Contains(t, string(rss), "<title>first</title>")
+
+	// The rendering is replaced together with the feed.
+	title = "second"
+	feeds.Update(context.Background())
+	rss, err = feeds.GetRSS("kindle")
+	require.Nil(t, err)
+	assert.Contains(t, string(rss), "<title>second</title>")
+	feed, err := feeds.Get("kindle")
+	require.Nil(t, err)
+	expected, err := feed.ToRss()
+	require.Nil(t, err)
+	assert.Equal(t, expected, string(rss))
+}
+
+func TestUpdateDisabled(t *testing.T) {
+	disabled := false
+	queries := Queries{queries: map[string]Query{"kindle": {}, "ipad": {Enabled: &disabled}}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	updates := 0
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		updates++
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	assert.Equal(t, 1, updates)
+	_, err := feeds.Get("kindle")
+	assert.Nil(t, err)
+	_, err = feeds.Get("ipad")
+	assert.Equal(t, ErrFeedNotFound, err)
+
+	// Disabling a query removes its feed.
+	queries.set(map[string]Query{"kindle": {Enabled: &disabled}})
+	due, _ := feeds.due(time.Now())
+	assert.Contains(t, due, "kindle")
+	feeds.update(context.Background(), due)
+	_, err = feeds.Get("kindle")
+	assert.Equal(t, ErrFeedNotFound, err)
+	assert.Empty(t, feeds.Status())
+	due, _ = feeds.due(time.Now())
+	assert.Empty(t, due)
+}
+
+func TestUpdateRemovedQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	write := func(names ...string) {
+		var b strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&b, "[%v]\nkeywords = [%q]\nlocation_name = \"Barcelona\"\nlocation_radius = 5\n",
+				name, name)
+		}
+		require.Nil(t, ioutil.WriteFile(path, []byte(b.String()), 0644))
+	}
+	write("kindle", "ipad")
+	queries, err := NewQueries(path)
+	require.Nil(t, err)
+	feeds := NewFeeds(queries, FeedsConfig{})
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+	_, err = feeds.Get("ipad")
+	require.Nil(t, err)
+
+	write("kindle")
+	require.Nil(t, queries.Load())
+	feeds.Update(context.Background())
+	_, err = feeds.Get("kindle")
+	assert.Nil(t, err)
+	_, err = feeds.Get("ipad")
+	assert.Equal(t, ErrFeedNotFound, err)
+	require.Len(t, feeds.Status(), 1)
+	assert.Equal(t, "kindle", feeds.Status()[0].Name)
+	assert.NotContains(t, feeds.seen, "ipad")
+}
+
+func TestUpdateChanged(t *testing.T) {
+	queries := Queries{queries: map[string]Query{
+		"kindle": {Keywords: []string{"kindle"}},
+		"ipad":   {Keywords: []string{"ipad"}},
+	}}
+	feeds := NewFeeds(&queries, FeedsConfig{})
+	var updated []string
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		updated = append(updated, query.Keywords[0])
+		return &gfeeds.Feed{Link: &gfeeds.Link{}}, nil
+	}
+	feeds.Update(context.Background())
+
+	old := queries.Get()
+	queries.set(map[string]Query{
+		"kindle": {Keywords: []string{"kindle"}},
+		"ipad":   {Keywords: []string{"ipad pro"}},
+		"iphone": {Keywords: []string{"iphone"}},
+	})
+	updated = nil
+	feeds.UpdateChanged(context.Background(), old)
+	assert.ElementsMatch(t, []string{"ipad pro", "iphone"}, updated)
+}
+
+func TestQueriesGetReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.toml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+[kindle]
+keywords = ["kindle"]
+location_name = "Barcelona"
+location_radius = 5
+`), 0644))
+	queries, err := NewQueries(path)
 	require.Nil(t, err)
 
-	// fmt.Printf("%#v\n", *feed)
-	fmt.Printf("%+v\n", *feed.Items[0])
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, queries.Load())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for name, query := range queries.Get() {
+			assert.Equal(t, "kindle", name)
+			assert.Equal(t, []string{"kindle"}, query.Keywords)
+		}
+	}
+}
+
+func TestQueriesGetCopy(t *testing.T) {
+	enabled := true
+	queries := Queries{queries: map[string]Query{"kindle": {
+		Enabled:   &enabled,
+		Keywords:  []string{"kindle"},
+		Ignores:   []string{"funda"},
+		Locations: []Location{{Name: "Barcelona", Radius: 5}},
+	}}}
+	original := queries.Get()["kindle"].clone()
+
+	// Concurrent callers can modify their copy without races.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := queries.Get()["kindle"]
+			*query.Enabled = false
+			query.Keywords[0] = "ipad"
+			query.Ignores[0] = "cable"
+			query.Locations[0].Radius = 10
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, original, queries.Get()["kindle"])
+}
+
+func TestUpdateStatus(t *testing.T) {
+	queries := Queries{queries: map[string]Query{"ok": {}, "bad": {}}}
+	feeds := NewFeeds(&queries, FeedsConfig{UpdateConcurrency: 1})
+	fail := false
+	feeds.genFeedFn = func(ctx context.Context, query *Query) (*gfeeds.Feed, error) {
+		if fail {
+			return nil, errors.New("upstream down")
+		}
+		return &gfeeds.Feed{Link: &gfeeds.Link{}, Items: []*gfeeds.Item{{Id: "a", Link: &gfeeds.Link{}}}}, nil
+	}
+	feeds.Update(context.Background())
+	fail = true
+	feeds.Update(context.Background())
+
+	status := feeds.Status()
+	require.Len(t, status, 2)
+	assert.Equal(t, "bad", status[0].Name)
+	assert.Equal(t, "ok", status[1].Name)
+	for _, s := range status {
+		assert.False(t, s.LastUpdated.IsZero(), s.Name)
+		assert.Equal(t, 1, s.Items, s.Name)
+		assert.Equal(t, "upstream down", s.LastError, s.Name)
+		assert.True(t, s.LastErrorTime.After(s.LastUpdated), s.Name)
+		_, err := feeds.Get(s.Name)
+		assert.Nil(t, err, s.Name)
+	}
 }